@@ -4,12 +4,15 @@ import (
 	"fmt"
 	"log"
 	"regexp"
+	"strconv"
 	"strings"
 	"time"
 
+	"github.com/influxdata/toml"
 	"github.com/shirou/gopsutil/disk"
 
 	"github.com/influxdata/telegraf"
+	"github.com/influxdata/telegraf/filter"
 	"github.com/influxdata/telegraf/plugins/inputs"
 )
 
@@ -22,6 +25,25 @@ type DiskStats struct {
 	MountPoints       []string
 	IgnoreMountPoints []string
 	IgnoreFS          []string `toml:"ignore_fs"`
+
+	InodeWarnPercent float64
+	MountPointTags   map[string]map[string]string
+	ReportUsedGrowth bool
+	FieldRename      map[string]string
+
+	UsedPercentFromTotal bool
+	ReportTotal          bool
+
+	initialized       bool
+	ignoreMountFilter filter.Filter
+	labelCache        map[string]string
+	lastUsed          map[diskUsageKey]uint64
+	lastTime          time.Time
+}
+
+type diskUsageKey struct {
+	device string
+	path   string
 }
 
 func (_ *DiskStats) Description() string {
@@ -33,28 +55,92 @@ var diskSampleConfig = `
   ## Setting mountpoints will restrict the stats to the specified mountpoints.
   # mount_points = ["/"]
 
-  # ignore_mount_points = ["/etc"]
+  ## Ignore some mountpoints by path, glob patterns are supported.
+  # ignore_mount_points = ["/etc", "/var/lib/docker/*"]
 
   ## Ignore some mountpoints by filesystem type. For example (dev)tmpfs (usually
   ## present on /run, /var/run, /dev/shm or /dev).
   ignore_fs = ["tmpfs", "devtmpfs", "devfs"]
+
+  ## Emit an inodes_exhausted field (0 or 1) telling whether inodes_used_percent
+  ## has reached the given threshold. Disabled when unset or 0.
+  # inode_warn_percent = 90.0
+
+  ## Emit a used_growth_bps field with the change of used space in bytes per
+  ## second since the previous gather.
+  # report_used_growth = false
+
+  ## Compute used_percent as used / total like gopsutil, instead of
+  ## used / (used + free). The two differ when blocks are reserved for root.
+  # used_percent_from_total = false
+
+  ## Emit a disk_total measurement with the space and inodes summed over all
+  ## gathered filesystems. A block device mounted at several paths, e.g. by
+  ## bind mounts, is only counted once.
+  # report_total = false
+
+  ## Rename emitted fields, e.g. to match existing dashboards.
+  # [inputs.disk.field_rename]
+  #   used_percent = "used_pct"
+
+  ## Extra tags to add per mount point. The longest configured mount point
+  ## which is a prefix of the partition path is used. Built-in tags are never
+  ## overwritten.
+  # [inputs.disk.mount_point_tags."/data/ssd"]
+  #   tier = "ssd"
 `
 
 func (_ *DiskStats) SampleConfig() string {
 	return diskSampleConfig
 }
 
+var diskFields = []string{
+	"total", "free", "used", "reserved", "used_percent", "used_percent_by_total",
+	"inodes_total", "inodes_free", "inodes_used", "inodes_used_percent",
+	"inodes_exhausted", "read_only", "used_growth_bps",
+}
+
+func (s *DiskStats) init() error {
+	if s.initialized {
+		return nil
+	}
+
+	if err := checkFieldRename(s.FieldRename, func(field string) bool {
+		return hasString(diskFields, field)
+	}); err != nil {
+		return err
+	}
+
+	f, err := filter.Compile(s.IgnoreMountPoints)
+	if err != nil {
+		return fmt.Errorf("error compiling ignore_mount_points: %s", err)
+	}
+	s.ignoreMountFilter = f
+
+	s.initialized = true
+	return nil
+}
+
 func (s *DiskStats) Gather(acc telegraf.Accumulator) error {
+	if err := s.init(); err != nil {
+		return err
+	}
+
 	// Legacy support:
 	if len(s.Mountpoints) != 0 {
 		s.MountPoints = s.Mountpoints
 	}
 
-	disks, partitions, err := s.ps.DiskUsage(s.MountPoints, s.IgnoreMountPoints, s.IgnoreFS)
+	disks, partitions, err := s.ps.DiskUsage(s.MountPoints, s.ignoreMountFilter, s.IgnoreFS)
 	if err != nil {
 		return fmt.Errorf("error getting disk usage info: %s", err)
 	}
 
+	curr := time.Now()
+	timeDelta := curr.Sub(s.lastTime).Seconds()
+	used := make(map[diskUsageKey]uint64)
+	var total diskTotal
+
 	for i, du := range disks {
 		if du.Total == 0 {
 			// Skip dummy filesystem (procfs, cgroupfs, ...)
@@ -68,8 +154,18 @@ func (s *DiskStats) Gather(acc telegraf.Accumulator) error {
 			"fstype": du.Fstype,
 			"mode":   mode,
 		}
+		if label := s.diskLabel(partitions[i].Device); len(label) > 0 {
+			tags["label"] = label
+		}
+		for k, v := range s.mountPointTags(du.Path) {
+			if _, ok := tags[k]; !ok {
+				tags[k] = v
+			}
+		}
 		var used_percent float64
-		if du.Used+du.Free > 0 {
+		if s.UsedPercentFromTotal {
+			used_percent = float64(du.Used) / float64(du.Total) * 100
+		} else if du.Used+du.Free > 0 {
 			used_percent = float64(du.Used) /
 				(float64(du.Used) + float64(du.Free)) * 100
 		}
@@ -82,33 +178,159 @@ func (s *DiskStats) Gather(acc telegraf.Accumulator) error {
 			inodesUsedPercent = float64(du.InodesUsed) /
 				(float64(du.InodesFree) + float64(du.InodesUsed)) * 100
 		}
+		var reserved uint64
+		if du.Total > du.Used+du.Free {
+			reserved = du.Total - du.Used - du.Free
+		}
 		fields := map[string]interface{}{
-			"total":               du.Total,
-			"free":                du.Free,
-			"used":                du.Used,
-			"used_percent":        used_percent,
-			"inodes_total":        du.InodesTotal,
-			"inodes_free":         du.InodesFree,
-			"inodes_used":         du.InodesUsed,
-			"inodes_used_percent": inodesUsedPercent,
-			"read_only":           ro,
+			"total":                 du.Total,
+			"free":                  du.Free,
+			"used":                  du.Used,
+			"reserved":              reserved,
+			"used_percent":          used_percent,
+			"used_percent_by_total": float64(du.Used) / float64(du.Total) * 100,
+			"inodes_total":          du.InodesTotal,
+			"inodes_free":           du.InodesFree,
+			"inodes_used":           du.InodesUsed,
+			"inodes_used_percent":   inodesUsedPercent,
+			"read_only":             ro,
+		}
+		if s.InodeWarnPercent > 0 {
+			exhausted := 0
+			if inodesUsedPercent >= s.InodeWarnPercent {
+				exhausted = 1
+			}
+			fields["inodes_exhausted"] = exhausted
+		}
+		if s.ReportUsedGrowth {
+			key := diskUsageKey{device: partitions[i].Device, path: du.Path}
+			if last, ok := s.lastUsed[key]; ok && timeDelta > 0 {
+				fields["used_growth_bps"] = (float64(du.Used) - float64(last)) / timeDelta
+			}
+			used[key] = du.Used
+		}
+		acc.AddGauge("disk", renameFields(fields, s.FieldRename), tags)
+
+		if s.ReportTotal {
+			total.add(partitions[i].Device, du)
 		}
-		acc.AddGauge("disk", fields, tags)
 	}
 
+	if s.ReportTotal && len(total.devices) > 0 {
+		acc.AddGauge("disk_total", renameFields(total.fields(s.UsedPercentFromTotal), s.FieldRename), nil)
+	}
+
+	// Only keep the partitions seen now, so a remounted partition starts over.
+	s.lastUsed = used
+	s.lastTime = curr
+
 	return nil
 }
 
+// diskTotal sums the usage of the gathered filesystems, counting every
+// block device once. Pseudo filesystems share generic device names such as
+// tmpfs or none, so each of their mounts is counted.
+type diskTotal struct {
+	devices     map[diskUsageKey]bool
+	total       uint64
+	free        uint64
+	used        uint64
+	inodesTotal uint64
+	inodesFree  uint64
+	inodesUsed  uint64
+}
+
+func (t *diskTotal) add(device string, du *disk.UsageStat) {
+	key := diskUsageKey{device: device}
+	if !strings.HasPrefix(device, "/dev/") {
+		key.path = du.Path
+	}
+	if t.devices == nil {
+		t.devices = make(map[diskUsageKey]bool)
+	}
+	if t.devices[key] {
+		return
+	}
+	t.devices[key] = true
+
+	t.total += du.Total
+	t.free += du.Free
+	t.used += du.Used
+	t.inodesTotal += du.InodesTotal
+	t.inodesFree += du.InodesFree
+	t.inodesUsed += du.InodesUsed
+}
+
+func (t *diskTotal) fields(usedPercentFromTotal bool) map[string]interface{} {
+	var used_percent float64
+	if usedPercentFromTotal {
+		if t.total > 0 {
+			used_percent = float64(t.used) / float64(t.total) * 100
+		}
+	} else if t.used+t.free > 0 {
+		used_percent = float64(t.used) /
+			(float64(t.used) + float64(t.free)) * 100
+	}
+	return map[string]interface{}{
+		"total":        t.total,
+		"free":         t.free,
+		"used":         t.used,
+		"used_percent": used_percent,
+		"inodes_total": t.inodesTotal,
+		"inodes_free":  t.inodesFree,
+		"inodes_used":  t.inodesUsed,
+	}
+}
+
+// mountPointTags returns the configured tags of the longest mount point
+// which is path itself or one of its parent directories.
+func (s *DiskStats) mountPointTags(path string) map[string]string {
+	var tags map[string]string
+	longest := -1
+	for mp, t := range s.MountPointTags {
+		if len(mp) <= longest || !hasPathPrefix(path, mp) {
+			continue
+		}
+		longest = len(mp)
+		tags = t
+	}
+	return tags
+}
+
+func hasPathPrefix(path, prefix string) bool {
+	if !strings.HasPrefix(path, prefix) {
+		return false
+	}
+	return len(path) == len(prefix) ||
+		strings.HasSuffix(prefix, "/") ||
+		path[len(prefix)] == '/'
+}
+
 type DiskIOStats struct {
 	ps PS
 
 	Devices          []string
 	DeviceTags       []string
 	NameTemplates    []string
-	Excludes         string
+	Excludes         excludeList
+	MatchBy          []string
 	SkipSerialNumber bool
 
-	infoCache map[string]diskInfoCache
+	ReportLatencyBuckets bool
+	LatencyBucketsMs     []float64
+	FieldRename          map[string]string
+	MeasurementName      string
+	ExcludeTags          map[string][]string
+	ReportAggregates     bool
+
+	initialized       bool
+	excludeRegs       []*regexp.Regexp
+	excludeTagFilters map[string]filter.Filter
+	infoCache         map[string]diskInfoCache
+	sysfsCache        map[string]map[string]interface{}
+	wwidCache         map[string]string
+
+	latencyBuckets map[string][]uint64
 
 	lastStats map[string]disk.IOCountersStat
 	lastTime  time.Time
@@ -123,6 +345,12 @@ var diskIoSampleConfig = `
   ## disk partitions.
   ## Setting devices will restrict the stats to the specified devices.
   # devices = ["sda", "sdb"]
+  ## Skip the devices whose name matches any of these regular expressions.
+  # excludes = ["^loop[0-9]+$", "^ram[0-9]+$"]
+  ## Identifiers of a device which devices and excludes are matched against,
+  ## any of "name", "devlinks", "wwid" and "serial". The kernel name is not
+  ## stable across reboots, e.g. for NVMe namespaces, while the others are.
+  # match_by = ["name"]
   ## Uncomment the following line if you need disk serial numbers.
   # skip_serial_number = false
   #
@@ -142,14 +370,112 @@ var diskIoSampleConfig = `
   ## The typical use case is for LVM volumes, to get the VG/LV name instead of
   ## the near-meaningless DM-0 name.
   # name_templates = ["$ID_FS_LABEL","$DM_VG_NAME/$DM_LV_NAME"]
+  #
+  ## Count the average read latency of every interval into cumulative
+  ## buckets, emitted as latency_le_<bound>ms and latency_le_inf counters.
+  # report_latency_buckets = false
+  # latency_buckets_ms = [1.0, 5.0, 10.0, 50.0, 100.0, 500.0, 1000.0]
+  #
+  ## Name of the measurement, e.g. to keep several diskio instances apart.
+  # measurement_name = "diskio"
+  #
+  ## Also emit the devices summed per controller, e.g. nvme0 for nvme0n1 and
+  ## nvme0n2 or sda for sda1 and sda2, as the "<measurement>_aggregate"
+  ## measurement. Partitions are only counted when their disk is not gathered.
+  # report_aggregates = false
+  #
+  ## Using the same metadata source as device_tags, devices can be skipped
+  ## when one of their properties matches any of the given glob patterns.
+  # [inputs.diskio.exclude_tags]
+  #   ID_MODEL = ["QEMU_HARDDISK", "Virtual*"]
+  #   ID_FS_TYPE = ["squashfs"]
+  #
+  ## Rename emitted fields, e.g. to match existing dashboards.
+  # [inputs.diskio.field_rename]
+  #   read_bytes = "read_bytes_total"
 `
 
 func (_ *DiskIOStats) SampleConfig() string {
 	return diskIoSampleConfig
 }
 
+var diskIOFields = []string{
+	"reads", "writes", "iocount", "merged_reads", "merged_writes",
+	"merged_iocount", "read_bytes", "write_bytes", "iobytes", "read_time",
+	"write_time", "io_time", "weighted_io_time", "iops_in_progress",
+	"iops", "read_iops", "write_iops", "read_bps", "write_bps",
+	"read_await", "write_await", "await", "ioutil", "avgqu_sz",
+	"counter_wrap", "latency_le_inf", "size_bytes", "rotational",
+}
+
+var diskIOMatchSources = []string{"name", "devlinks", "wwid", "serial"}
+
+func (s *DiskIOStats) init() error {
+	if s.initialized {
+		return nil
+	}
+
+	if err := checkFieldRename(s.FieldRename, func(field string) bool {
+		return hasString(diskIOFields, field) ||
+			(strings.HasPrefix(field, "latency_le_") && strings.HasSuffix(field, "ms"))
+	}); err != nil {
+		return err
+	}
+
+	for _, source := range s.MatchBy {
+		if !hasString(diskIOMatchSources, source) {
+			return fmt.Errorf("match_by: unknown source %q, must be one of %s",
+				source, strings.Join(diskIOMatchSources, ", "))
+		}
+	}
+
+	s.excludeRegs = nil
+	for _, pattern := range s.Excludes {
+		if len(pattern) == 0 {
+			// excludes = "" used to mean no excludes, not matching everything
+			continue
+		}
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return fmt.Errorf("error compiling excludes pattern %q: %s", pattern, err)
+		}
+		s.excludeRegs = append(s.excludeRegs, re)
+	}
+
+	s.excludeTagFilters = make(map[string]filter.Filter)
+	for tag, patterns := range s.ExcludeTags {
+		f, err := filter.Compile(patterns)
+		if err != nil {
+			return fmt.Errorf("error compiling exclude_tags for %s: %s", tag, err)
+		}
+		if f != nil {
+			s.excludeTagFilters[tag] = f
+		}
+	}
+
+	s.initialized = true
+	return nil
+}
+
 func (s *DiskIOStats) Gather(acc telegraf.Accumulator) error {
-	diskio, err := s.ps.DiskIO(s.Devices)
+	if err := s.init(); err != nil {
+		return err
+	}
+
+	measurement := "diskio"
+	if len(s.MeasurementName) > 0 {
+		measurement = s.MeasurementName
+	}
+
+	// The devices can only be selected by name before gathering, the other
+	// identifiers are matched against every device afterwards.
+	devices := s.Devices
+	filterDevices := len(devices) > 0 && !s.matchByNameOnly()
+	if filterDevices {
+		devices = nil
+	}
+
+	diskio, err := s.ps.DiskIO(devices)
 	if err != nil {
 		return fmt.Errorf("error getting disk io info: %s", err)
 	}
@@ -157,15 +483,20 @@ func (s *DiskIOStats) Gather(acc telegraf.Accumulator) error {
 	curr := time.Now()
 	timeDelta := curr.Sub(s.lastTime).Seconds()
 
-	var excludeReg *regexp.Regexp
-	if len(s.Excludes) > 0 {
-		excludeReg = regexp.MustCompile(s.Excludes)
-	}
-
+	var gathered []disk.IOCountersStat
 	for _, io := range diskio {
-		if excludeReg != nil && excludeReg.MatchString(io.Name) {
+		names := s.matchNames(io)
+		if filterDevices && !s.selected(names) {
+			continue
+		}
+		if s.excluded(names) {
+			continue
+		}
+		if s.excludedByTags(io.Name) {
 			continue
 		}
+		gathered = append(gathered, io)
+
 		tags := map[string]string{}
 		tags["name"] = s.diskName(io.Name)
 		for t, v := range s.diskTags(io.Name) {
@@ -179,68 +510,43 @@ func (s *DiskIOStats) Gather(acc telegraf.Accumulator) error {
 			}
 		}
 
-		fields := map[string]interface{}{
-			"reads":            io.ReadCount,
-			"writes":           io.WriteCount,
-			"iocount":          io.ReadCount + io.WriteCount,
-			"merged_reads":     io.MergedReadCount,
-			"merged_writes":    io.MergedWriteCount,
-			"merged_iocount":   io.MergedReadCount + io.MergedWriteCount,
-			"read_bytes":       io.ReadBytes,
-			"write_bytes":      io.WriteBytes,
-			"iobytes":          io.ReadBytes + io.WriteBytes,
-			"read_time":        io.ReadTime,   // ms
-			"write_time":       io.WriteTime,  // ms
-			"io_time":          io.IoTime,     // ms
-			"weighted_io_time": io.WeightedIO, // ms
-			"iops_in_progress": io.IopsInProgress,
-		}
-		acc.AddCounter("diskio", fields, tags, curr)
-
-		if len(s.lastStats) == 0 {
-			// If it's the 1st gather, can't get CPU Usage stats yet
-			continue
+		fields := diskIOCounterFields(io)
+		for k, v := range s.diskSysfsFields(io.Name) {
+			fields[k] = v
 		}
-
 		last, ok := s.lastStats[io.Name]
-		if !ok {
-			continue
+		wrapped := ok && counterWrapped(io, last)
+		if wrapped {
+			// Deltas are meaningless for this interval, only flag it
+			fields["counter_wrap"] = 1
 		}
+		acc.AddCounter(measurement, renameFields(fields, s.FieldRename), tags, curr)
 
-		readIo := io.ReadCount - last.ReadCount
-		writeIo := io.WriteCount - last.WriteCount
-		readBytes := io.ReadBytes - last.ReadBytes
-		writeBytes := io.WriteBytes - last.WriteBytes
-		readTime := io.ReadTime - last.ReadTime
-		writeTime := io.WriteTime - last.WriteTime
-		ioTime := io.IoTime - last.IoTime
-		weightedIoTime := io.WeightedIO - last.WeightedIO
-		readAwait := 0.0
-		if readIo > 0 {
-			readAwait = float64(readTime) / float64(readIo)
-		}
-		writeAwait := 0.0
-		if writeIo > 0 {
-			writeAwait = float64(writeTime) / float64(writeIo)
+		if !ok {
+			// If it's the 1st gather, can't get rate stats yet
+			continue
 		}
-		ioAwait := 0.0
-		if readIo+writeIo > 0 {
-			ioAwait = float64(readTime+writeTime) / float64(readIo+writeIo)
+		if wrapped {
+			if s.ReportLatencyBuckets {
+				buckets := s.latencyBucketFields(io.Name, 0, 0, true)
+				acc.AddCounter(measurement, renameFields(buckets, s.FieldRename), tags, curr)
+			}
+			continue
 		}
 
-		fields2 := map[string]interface{}{
-			"iops":        float64(readIo+writeIo) / timeDelta,
-			"read_iops":   float64(readIo) / timeDelta,
-			"write_iops":  float64(writeIo) / timeDelta,
-			"read_bps":    float64(readBytes) / timeDelta,
-			"write_bps":   float64(writeBytes) / timeDelta,
-			"read_await":  readAwait,
-			"write_await": writeAwait,
-			"await":       ioAwait,
-			"ioutil":      float64(ioTime*100) / timeDelta / 1000.0,
-			"avgqu_sz":    float64(weightedIoTime) / timeDelta / 1000.0,
+		fields2 := diskIORateFields(io, last, timeDelta)
+		acc.AddGauge(measurement, renameFields(fields2, s.FieldRename), tags, curr)
+
+		if s.ReportLatencyBuckets {
+			readTime := io.ReadTime - last.ReadTime
+			readIo := io.ReadCount - last.ReadCount
+			buckets := s.latencyBucketFields(io.Name, readTime, readIo, false)
+			acc.AddCounter(measurement, renameFields(buckets, s.FieldRename), tags, curr)
 		}
-		acc.AddGauge("diskio", fields2, tags, curr)
+	}
+
+	if s.ReportAggregates {
+		s.gatherAggregates(acc, measurement+"_aggregate", gathered, curr, timeDelta)
 	}
 
 	s.lastStats = make(map[string]disk.IOCountersStat)
@@ -252,6 +558,225 @@ func (s *DiskIOStats) Gather(acc telegraf.Accumulator) error {
 	return nil
 }
 
+func diskIOCounterFields(io disk.IOCountersStat) map[string]interface{} {
+	return map[string]interface{}{
+		"reads":            io.ReadCount,
+		"writes":           io.WriteCount,
+		"iocount":          io.ReadCount + io.WriteCount,
+		"merged_reads":     io.MergedReadCount,
+		"merged_writes":    io.MergedWriteCount,
+		"merged_iocount":   io.MergedReadCount + io.MergedWriteCount,
+		"read_bytes":       io.ReadBytes,
+		"write_bytes":      io.WriteBytes,
+		"iobytes":          io.ReadBytes + io.WriteBytes,
+		"read_time":        io.ReadTime,   // ms
+		"write_time":       io.WriteTime,  // ms
+		"io_time":          io.IoTime,     // ms
+		"weighted_io_time": io.WeightedIO, // ms
+		"iops_in_progress": io.IopsInProgress,
+	}
+}
+
+// diskIORateFields returns the rates and average latencies over the
+// interval between the last and the current counters.
+func diskIORateFields(io, last disk.IOCountersStat, timeDelta float64) map[string]interface{} {
+	readIo := io.ReadCount - last.ReadCount
+	writeIo := io.WriteCount - last.WriteCount
+	readBytes := io.ReadBytes - last.ReadBytes
+	writeBytes := io.WriteBytes - last.WriteBytes
+	readTime := io.ReadTime - last.ReadTime
+	writeTime := io.WriteTime - last.WriteTime
+	ioTime := io.IoTime - last.IoTime
+	weightedIoTime := io.WeightedIO - last.WeightedIO
+	readAwait := 0.0
+	if readIo > 0 {
+		readAwait = float64(readTime) / float64(readIo)
+	}
+	writeAwait := 0.0
+	if writeIo > 0 {
+		writeAwait = float64(writeTime) / float64(writeIo)
+	}
+	ioAwait := 0.0
+	if readIo+writeIo > 0 {
+		ioAwait = float64(readTime+writeTime) / float64(readIo+writeIo)
+	}
+
+	return map[string]interface{}{
+		"iops":        float64(readIo+writeIo) / timeDelta,
+		"read_iops":   float64(readIo) / timeDelta,
+		"write_iops":  float64(writeIo) / timeDelta,
+		"read_bps":    float64(readBytes) / timeDelta,
+		"write_bps":   float64(writeBytes) / timeDelta,
+		"read_await":  readAwait,
+		"write_await": writeAwait,
+		"await":       ioAwait,
+		"ioutil":      float64(ioTime*100) / timeDelta / 1000.0,
+		"avgqu_sz":    float64(weightedIoTime) / timeDelta / 1000.0,
+	}
+}
+
+// gatherAggregates sums the counters of the gathered devices per controller.
+// The rates are computed from the sum of the deltas of the devices which have
+// a valid one, so a device which was missing or wrapped since the last gather
+// does not count its lifetime counters as the IO of one interval. A partition
+// is only counted when its whole disk was not gathered, so no IO is counted
+// twice.
+func (s *DiskIOStats) gatherAggregates(acc telegraf.Accumulator, measurement string, ios []disk.IOCountersStat, curr time.Time, timeDelta float64) {
+	whole := make(map[string]bool)
+	for _, io := range ios {
+		if diskIOParent(io.Name) == io.Name {
+			whole[io.Name] = true
+		}
+	}
+
+	sums := make(map[string]disk.IOCountersStat)
+	deltas := make(map[string]disk.IOCountersStat)
+	wrapped := make(map[string]bool)
+	for _, io := range ios {
+		parent := diskIOParent(io.Name)
+		if parent != io.Name && whole[parent] {
+			continue
+		}
+		controller := diskIOController(parent)
+		sums[controller] = addIOCounters(sums[controller], io)
+
+		last, ok := s.lastStats[io.Name]
+		if !ok {
+			continue
+		}
+		if counterWrapped(io, last) {
+			wrapped[controller] = true
+			continue
+		}
+		deltas[controller] = addIOCounters(deltas[controller], subIOCounters(io, last))
+	}
+
+	for controller, sum := range sums {
+		tags := map[string]string{"name": controller}
+		sum.Name = controller
+		fields := diskIOCounterFields(sum)
+		if wrapped[controller] {
+			fields["counter_wrap"] = 1
+		}
+		acc.AddCounter(measurement, renameFields(fields, s.FieldRename), tags, curr)
+
+		if delta, ok := deltas[controller]; ok {
+			fields2 := diskIORateFields(delta, disk.IOCountersStat{}, timeDelta)
+			acc.AddGauge(measurement, renameFields(fields2, s.FieldRename), tags, curr)
+		}
+	}
+}
+
+func addIOCounters(a, b disk.IOCountersStat) disk.IOCountersStat {
+	a.ReadCount += b.ReadCount
+	a.MergedReadCount += b.MergedReadCount
+	a.WriteCount += b.WriteCount
+	a.MergedWriteCount += b.MergedWriteCount
+	a.ReadBytes += b.ReadBytes
+	a.WriteBytes += b.WriteBytes
+	a.ReadTime += b.ReadTime
+	a.WriteTime += b.WriteTime
+	a.IopsInProgress += b.IopsInProgress
+	a.IoTime += b.IoTime
+	a.WeightedIO += b.WeightedIO
+	return a
+}
+
+// subIOCounters returns the deltas of the counters from b to a.
+func subIOCounters(a, b disk.IOCountersStat) disk.IOCountersStat {
+	a.ReadCount -= b.ReadCount
+	a.MergedReadCount -= b.MergedReadCount
+	a.WriteCount -= b.WriteCount
+	a.MergedWriteCount -= b.MergedWriteCount
+	a.ReadBytes -= b.ReadBytes
+	a.WriteBytes -= b.WriteBytes
+	a.ReadTime -= b.ReadTime
+	a.WriteTime -= b.WriteTime
+	a.IopsInProgress -= b.IopsInProgress
+	a.IoTime -= b.IoTime
+	a.WeightedIO -= b.WeightedIO
+	return a
+}
+
+var (
+	diskIOPartitionRegexes = []*regexp.Regexp{
+		regexp.MustCompile(`^(nvme[0-9]+n[0-9]+)p[0-9]+$`),
+		regexp.MustCompile(`^(mmcblk[0-9]+)p[0-9]+$`),
+		regexp.MustCompile(`^((?:[shv]|xv)d[a-z]+)[0-9]+$`),
+	}
+	nvmeNamespaceRegex = regexp.MustCompile(`^(nvme[0-9]+)n[0-9]+$`)
+)
+
+// diskIOParent returns the whole disk of a partition, or the device itself.
+func diskIOParent(devName string) string {
+	for _, re := range diskIOPartitionRegexes {
+		if m := re.FindStringSubmatch(devName); m != nil {
+			return m[1]
+		}
+	}
+	return devName
+}
+
+// diskIOController returns the NVMe controller of a namespace, or the disk
+// itself for any other disk.
+func diskIOController(diskName string) string {
+	if m := nvmeNamespaceRegex.FindStringSubmatch(diskName); m != nil {
+		return m[1]
+	}
+	return diskName
+}
+
+// counterWrapped returns true if any of the counters used for the rate
+// fields went backwards since the last gather.
+func counterWrapped(curr, last disk.IOCountersStat) bool {
+	return curr.ReadCount < last.ReadCount ||
+		curr.WriteCount < last.WriteCount ||
+		curr.ReadBytes < last.ReadBytes ||
+		curr.WriteBytes < last.WriteBytes ||
+		curr.ReadTime < last.ReadTime ||
+		curr.WriteTime < last.WriteTime ||
+		curr.IoTime < last.IoTime ||
+		curr.WeightedIO < last.WeightedIO
+}
+
+var defaultLatencyBucketsMs = []float64{1, 5, 10, 50, 100, 500, 1000}
+
+// latencyBucketFields adds the average latency of the last interval to the
+// cumulative buckets of the device and returns the bucket counters. The
+// buckets of the device are reset when its counters wrapped.
+func (s *DiskIOStats) latencyBucketFields(name string, readTime, readIo uint64, wrapped bool) map[string]interface{} {
+	bounds := s.LatencyBucketsMs
+	if len(bounds) == 0 {
+		bounds = defaultLatencyBucketsMs
+	}
+
+	if s.latencyBuckets == nil {
+		s.latencyBuckets = make(map[string][]uint64)
+	}
+	buckets, ok := s.latencyBuckets[name]
+	if !ok || wrapped || len(buckets) != len(bounds)+1 {
+		buckets = make([]uint64, len(bounds)+1)
+		s.latencyBuckets[name] = buckets
+	}
+
+	if !wrapped && readIo > 0 {
+		latency := float64(readTime) / float64(readIo)
+		for i, bound := range bounds {
+			if latency <= bound {
+				buckets[i]++
+			}
+		}
+		buckets[len(bounds)]++
+	}
+
+	fields := make(map[string]interface{}, len(buckets))
+	for i, bound := range bounds {
+		fields["latency_le_"+strconv.FormatFloat(bound, 'f', -1, 64)+"ms"] = buckets[i]
+	}
+	fields["latency_le_inf"] = buckets[len(bounds)]
+	return fields
+}
+
 var varRegex = regexp.MustCompile(`\$(?:\w+|\{\w+\})`)
 
 func (s *DiskIOStats) diskName(devName string) string {
@@ -308,6 +833,155 @@ func (s *DiskIOStats) diskTags(devName string) map[string]string {
 	return tags
 }
 
+// checkFieldRename returns an error if the field_rename mapping refers to a
+// field the plugin does not emit, renames a field to an empty name or to the
+// name of another emitted field, or renames two fields to the same name.
+func checkFieldRename(mapping map[string]string, known func(string) bool) error {
+	targets := make(map[string]string, len(mapping))
+	for from, to := range mapping {
+		if !known(from) {
+			return fmt.Errorf("field_rename: unknown field %q", from)
+		}
+		if len(to) == 0 {
+			return fmt.Errorf("field_rename: empty new name for field %q", from)
+		}
+		if other, ok := targets[to]; ok {
+			return fmt.Errorf("field_rename: fields %q and %q both renamed to %q", other, from, to)
+		}
+		targets[to] = from
+		if _, renamed := mapping[to]; known(to) && !renamed {
+			return fmt.Errorf("field_rename: field %q renamed to the name of field %q", from, to)
+		}
+	}
+	return nil
+}
+
+func renameFields(fields map[string]interface{}, mapping map[string]string) map[string]interface{} {
+	if len(mapping) == 0 {
+		return fields
+	}
+
+	renamed := make(map[string]interface{}, len(fields))
+	for k, v := range fields {
+		if to, ok := mapping[k]; ok {
+			k = to
+		}
+		renamed[k] = v
+	}
+	return renamed
+}
+
+func hasString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *DiskIOStats) matchByNameOnly() bool {
+	for _, source := range s.MatchBy {
+		if source != "name" {
+			return false
+		}
+	}
+	return true
+}
+
+// matchNames returns the identifiers of the device selected by match_by,
+// which devices and excludes are matched against.
+func (s *DiskIOStats) matchNames(io disk.IOCountersStat) []string {
+	if len(s.MatchBy) == 0 {
+		return []string{io.Name}
+	}
+
+	var names []string
+	for _, source := range s.MatchBy {
+		switch source {
+		case "name":
+			names = append(names, io.Name)
+		case "devlinks":
+			di, err := s.diskInfo(io.Name)
+			if err != nil {
+				continue
+			}
+			names = append(names, strings.Fields(di["DEVLINKS"])...)
+		case "wwid":
+			if wwid := s.diskWWID(io.Name); len(wwid) > 0 {
+				names = append(names, wwid)
+			}
+		case "serial":
+			if len(io.SerialNumber) > 0 {
+				names = append(names, io.SerialNumber)
+			}
+		}
+	}
+	return names
+}
+
+func (s *DiskIOStats) selected(names []string) bool {
+	for _, name := range names {
+		if hasString(s.Devices, name) {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *DiskIOStats) excluded(names []string) bool {
+	for _, re := range s.excludeRegs {
+		for _, name := range names {
+			if re.MatchString(name) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// excludedByTags returns true if one of the device properties matches its
+// exclude_tags filter.
+func (s *DiskIOStats) excludedByTags(devName string) bool {
+	if len(s.excludeTagFilters) == 0 {
+		return false
+	}
+
+	di, err := s.diskInfo(devName)
+	if err != nil {
+		log.Printf("W! Error gathering disk info: %s", err)
+		return false
+	}
+
+	for tag, f := range s.excludeTagFilters {
+		if v, ok := di[tag]; ok && f.Match(v) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// excludeList is a list of exclude patterns which also accepts a single
+// string, as excludes used to be one regular expression.
+type excludeList []string
+
+func (l *excludeList) UnmarshalTOML(b []byte) error {
+	var v struct {
+		List   []string
+		Single string
+	}
+	if err := toml.Unmarshal([]byte("list = "+string(b)), &v); err == nil {
+		*l = v.List
+		return nil
+	}
+	if err := toml.Unmarshal([]byte("single = "+string(b)), &v); err != nil {
+		return fmt.Errorf("excludes must be a string or a list of strings: %s", err)
+	}
+	*l = excludeList{v.Single}
+	return nil
+}
+
 type MountOptions []string
 
 func (opts MountOptions) Mode() string {
@@ -3,7 +3,11 @@ package system
 import (
 	"bufio"
 	"fmt"
+	"io/ioutil"
+	"log"
 	"os"
+	"path/filepath"
+	"strconv"
 	"strings"
 
 	"golang.org/x/sys/unix"
@@ -16,6 +20,10 @@ type diskInfoCache struct {
 
 var udevPath = "/run/udev/data"
 
+var sysBlockPath = "/sys/class/block"
+
+var diskByLabelPath = "/dev/disk/by-label"
+
 func (s *DiskIOStats) diskInfo(devName string) (map[string]string, error) {
 	var err error
 	var stat unix.Stat_t
@@ -66,3 +74,117 @@ func (s *DiskIOStats) diskInfo(devName string) (map[string]string, error) {
 
 	return di, nil
 }
+
+// diskSysfsFields returns the size and, for whole disks, the rotational
+// flag of the device as reported by sysfs. Neither changes at runtime, so
+// they are only read once per device.
+func (s *DiskIOStats) diskSysfsFields(devName string) map[string]interface{} {
+	if s.sysfsCache == nil {
+		s.sysfsCache = map[string]map[string]interface{}{}
+	}
+	if fields, ok := s.sysfsCache[devName]; ok {
+		return fields
+	}
+
+	fields := map[string]interface{}{}
+	devPath := filepath.Join(sysBlockPath, devName)
+	if sectors, err := readSysfsUint(filepath.Join(devPath, "size")); err == nil {
+		// sysfs always counts in 512 byte sectors
+		fields["size_bytes"] = sectors * 512
+	}
+	if rotational, err := readSysfsUint(filepath.Join(devPath, "queue", "rotational")); err == nil {
+		fields["rotational"] = rotational
+	}
+
+	s.sysfsCache[devName] = fields
+	return fields
+}
+
+// diskWWID returns the world wide identifier of the device from sysfs,
+// which NVMe namespaces report directly and SCSI disks on their device.
+func (s *DiskIOStats) diskWWID(devName string) string {
+	if s.wwidCache == nil {
+		s.wwidCache = map[string]string{}
+	}
+	if wwid, ok := s.wwidCache[devName]; ok {
+		return wwid
+	}
+
+	var wwid string
+	devPath := filepath.Join(sysBlockPath, devName)
+	for _, path := range []string{
+		filepath.Join(devPath, "wwid"),
+		filepath.Join(devPath, "device", "wwid"),
+	} {
+		if b, err := ioutil.ReadFile(path); err == nil {
+			wwid = strings.TrimSpace(string(b))
+			break
+		}
+	}
+
+	s.wwidCache[devName] = wwid
+	return wwid
+}
+
+func readSysfsUint(path string) (uint64, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseUint(strings.TrimSpace(string(b)), 10, 64)
+}
+
+// diskLabel returns the filesystem label of the partition device from the
+// udev by-label symlinks, or "" if it has none. Pseudo filesystems such as
+// tmpfs or overlay are not backed by a device and never have a label.
+func (s *DiskStats) diskLabel(device string) string {
+	if !strings.HasPrefix(device, "/dev/") {
+		return ""
+	}
+	if s.labelCache == nil {
+		s.labelCache = map[string]string{}
+	}
+	if label, ok := s.labelCache[device]; ok {
+		return label
+	}
+
+	name := filepath.Base(device)
+	if resolved, err := filepath.EvalSymlinks(device); err == nil {
+		name = filepath.Base(resolved)
+	}
+
+	var label string
+	links, err := ioutil.ReadDir(diskByLabelPath)
+	if err != nil && !os.IsNotExist(err) {
+		log.Printf("W! Error reading disk labels: %s", err)
+	}
+	for _, link := range links {
+		target, err := os.Readlink(filepath.Join(diskByLabelPath, link.Name()))
+		if err != nil {
+			continue
+		}
+		if filepath.Base(target) == name {
+			label = unescapeLabel(link.Name())
+			break
+		}
+	}
+
+	s.labelCache[device] = label
+	return label
+}
+
+// unescapeLabel decodes the \xNN escapes udev uses in by-label names.
+func unescapeLabel(s string) string {
+	var b []byte
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+3 < len(s) && s[i+1] == 'x' {
+			if c, err := strconv.ParseUint(s[i+2:i+4], 16, 8); err == nil {
+				b = append(b, byte(c))
+				i += 3
+				continue
+			}
+		}
+		b = append(b, s[i])
+	}
+	return string(b)
+}
@@ -3,19 +3,51 @@
 package system
 
 import (
+	"fmt"
 	"io/ioutil"
 	"os"
+	"path/filepath"
+	"sort"
 	"testing"
 
+	"github.com/influxdata/telegraf/testutil"
+	"github.com/shirou/gopsutil/disk"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
 	"github.com/stretchr/testify/require"
 )
 
 var nullDiskInfo = []byte(`
 E:MY_PARAM_1=myval1
 E:MY_PARAM_2=myval2
+E:ID_FS_TYPE=squashfs
+E:DEVLINKS=/dev/disk/by-id/null-disk /dev/disk/by-path/null-path
 `)
 
+// TestMain points the label and sysfs lookups at empty directories, so the
+// Gather tests don't pick up the filesystem labels and disks of the host.
+func TestMain(m *testing.M) {
+	td, err := ioutil.TempDir("", ".telegraf.TestDisk")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	diskByLabelPath = filepath.Join(td, "by-label")
+	sysBlockPath = filepath.Join(td, "block")
+	for _, dir := range []string{diskByLabelPath, sysBlockPath} {
+		if err := os.Mkdir(dir, 0755); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.RemoveAll(td)
+			os.Exit(1)
+		}
+	}
+
+	rc := m.Run()
+
+	os.RemoveAll(td)
+	os.Exit(rc)
+}
+
 // setupNullDisk sets up fake udev info as if /dev/null were a disk.
 func setupNullDisk(t *testing.T) func() error {
 	td, err := ioutil.TempDir("", ".telegraf.TestDiskInfo")
@@ -99,3 +131,193 @@ func TestDiskIOStats_diskTags(t *testing.T) {
 	dt := s.diskTags("null")
 	assert.Equal(t, map[string]string{"MY_PARAM_2": "myval2"}, dt)
 }
+
+func TestDiskIOStats_excludeTags(t *testing.T) {
+	defer setupNullDisk(t)()
+
+	var mps MockPS
+	mps.On("DiskIO").Return(map[string]disk.IOCountersStat{
+		"null":   {Name: "null", ReadCount: 1},
+		"zero42": {Name: "zero42", ReadCount: 2},
+	}, nil)
+
+	tests := []struct {
+		excludeTags map[string][]string
+		expected    []string
+	}{
+		{nil, []string{"null", "zero42"}},
+		{map[string][]string{"ID_FS_TYPE": {"squashfs"}}, []string{"zero42"}},
+		{map[string][]string{"ID_FS_TYPE": {"squash*"}}, []string{"zero42"}},
+		{map[string][]string{"ID_FS_TYPE": {"ext4"}}, []string{"null", "zero42"}},
+		{map[string][]string{"ID_MODEL": {"*"}}, []string{"null", "zero42"}},
+	}
+
+	for _, tc := range tests {
+		var acc testutil.Accumulator
+		s := &DiskIOStats{ps: &mps, SkipSerialNumber: true, ExcludeTags: tc.excludeTags}
+		require.NoError(t, s.Gather(&acc))
+
+		var names []string
+		for _, m := range acc.Metrics {
+			names = append(names, m.Tags["name"])
+		}
+		sort.Strings(names)
+		assert.Equal(t, tc.expected, names, "exclude_tags: %#v", tc.excludeTags)
+	}
+}
+
+func TestDiskIOStats_sysfsFields(t *testing.T) {
+	td, err := ioutil.TempDir("", ".telegraf.TestDiskSysfs")
+	require.NoError(t, err)
+	defer os.RemoveAll(td)
+
+	origSysBlockPath := sysBlockPath
+	defer func() { sysBlockPath = origSysBlockPath }()
+	sysBlockPath = td
+
+	require.NoError(t, os.MkdirAll(td+"/sda/queue", 0755))
+	require.NoError(t, ioutil.WriteFile(td+"/sda/size", []byte("1953525168\n"), 0644))
+	require.NoError(t, ioutil.WriteFile(td+"/sda/queue/rotational", []byte("1\n"), 0644))
+	require.NoError(t, os.MkdirAll(td+"/sda1", 0755))
+	require.NoError(t, ioutil.WriteFile(td+"/sda1/size", []byte("2048\n"), 0644))
+
+	var mps MockPS
+	mps.On("DiskIO").Return(map[string]disk.IOCountersStat{
+		"sda":  {Name: "sda"},
+		"sda1": {Name: "sda1"},
+		"sdb":  {Name: "sdb"},
+	}, nil)
+
+	var acc testutil.Accumulator
+	s := &DiskIOStats{ps: &mps, SkipSerialNumber: true}
+	require.NoError(t, s.Gather(&acc))
+
+	fields := map[string]map[string]interface{}{}
+	for _, m := range acc.Metrics {
+		fields[m.Tags["name"]] = m.Fields
+	}
+	assert.Equal(t, uint64(1000204886016), fields["sda"]["size_bytes"])
+	assert.Equal(t, uint64(1), fields["sda"]["rotational"])
+	assert.Equal(t, uint64(1048576), fields["sda1"]["size_bytes"])
+	assert.NotContains(t, fields["sda1"], "rotational")
+	assert.NotContains(t, fields["sdb"], "size_bytes")
+	assert.NotContains(t, fields["sdb"], "rotational")
+
+	// values are cached
+	require.NoError(t, os.RemoveAll(td+"/sda"))
+	acc.ClearMetrics()
+	require.NoError(t, s.Gather(&acc))
+	assert.True(t, acc.HasField("diskio", "rotational"))
+}
+
+func TestDiskStats_label(t *testing.T) {
+	td, err := ioutil.TempDir("", ".telegraf.TestDiskLabel")
+	require.NoError(t, err)
+	defer os.RemoveAll(td)
+
+	origDiskByLabelPath := diskByLabelPath
+	defer func() { diskByLabelPath = origDiskByLabelPath }()
+	diskByLabelPath = td
+
+	require.NoError(t, os.Symlink("../../sdz1", td+"/root"))
+	require.NoError(t, os.Symlink("../../sdz2", td+`/my\x20data`))
+	// must not be matched by name for a pseudo filesystem
+	require.NoError(t, os.Symlink("../../tmpfs", td+"/scratch"))
+
+	mck := &mock.Mock{}
+	mps := MockPSDisk{&systemPS{&mockDiskUsage{mck}}, mck}
+
+	psAll := []disk.PartitionStat{
+		{Device: "/dev/sdz1", Mountpoint: "/", Fstype: "ext4", Opts: "rw"},
+		{Device: "/dev/sdz2", Mountpoint: "/data", Fstype: "ext4", Opts: "rw"},
+		{Device: "/dev/sdz3", Mountpoint: "/home", Fstype: "ext4", Opts: "rw"},
+		{Device: "tmpfs", Mountpoint: "/run", Fstype: "tmpfs", Opts: "rw"},
+	}
+	mps.On("Partitions", true).Return(psAll, nil)
+	mps.On("OSGetenv", "HOST_MOUNT_PREFIX").Return("")
+	for _, p := range psAll {
+		mps.On("PSDiskUsage", p.Mountpoint).Return(&disk.UsageStat{Path: p.Mountpoint, Total: 42}, nil)
+	}
+
+	var acc testutil.Accumulator
+	d := &DiskStats{ps: mps}
+	require.NoError(t, d.Gather(&acc))
+
+	labels := map[string]string{}
+	for _, m := range acc.Metrics {
+		if label, ok := m.Tags["label"]; ok {
+			labels[m.Tags["path"]] = label
+		}
+	}
+	assert.Equal(t, map[string]string{"/": "root", "/data": "my data"}, labels)
+
+	// lookups are cached
+	require.NoError(t, os.Remove(td+"/root"))
+	acc.ClearMetrics()
+	require.NoError(t, d.Gather(&acc))
+	for _, m := range acc.Metrics {
+		if m.Tags["path"] == "/" {
+			assert.Equal(t, "root", m.Tags["label"])
+		}
+	}
+}
+
+func TestDiskIOStats_matchBy(t *testing.T) {
+	defer setupNullDisk(t)()
+
+	td, err := ioutil.TempDir("", ".telegraf.TestDiskWWID")
+	require.NoError(t, err)
+	defer os.RemoveAll(td)
+
+	origSysBlockPath := sysBlockPath
+	defer func() { sysBlockPath = origSysBlockPath }()
+	sysBlockPath = td
+
+	// NVMe namespaces report the wwid directly, SCSI disks on their device
+	require.NoError(t, os.MkdirAll(td+"/nvme0n1", 0755))
+	require.NoError(t, ioutil.WriteFile(td+"/nvme0n1/wwid", []byte("eui.0025388b91b2c4a1\n"), 0644))
+	require.NoError(t, os.MkdirAll(td+"/sda/device", 0755))
+	require.NoError(t, ioutil.WriteFile(td+"/sda/device/wwid", []byte("naa.5000c500a1b2c3d4\n"), 0644))
+
+	var mps MockPS
+	mps.On("DiskIO").Return(map[string]disk.IOCountersStat{
+		"null":    {Name: "null"},
+		"nvme0n1": {Name: "nvme0n1"},
+		"sda":     {Name: "sda"},
+	}, nil)
+
+	tests := []struct {
+		matchBy  []string
+		devices  []string
+		excludes []string
+		expected []string
+	}{
+		{[]string{"devlinks"}, []string{"/dev/disk/by-id/null-disk"}, nil, []string{"null"}},
+		{[]string{"devlinks"}, []string{"null"}, nil, nil},
+		{[]string{"devlinks"}, nil, []string{"by-path"}, []string{"nvme0n1", "sda"}},
+		{nil, nil, []string{"by-path"}, []string{"null", "nvme0n1", "sda"}},
+		{[]string{"wwid"}, []string{"eui.0025388b91b2c4a1"}, nil, []string{"nvme0n1"}},
+		{[]string{"wwid"}, nil, []string{"^naa\\."}, []string{"null", "nvme0n1"}},
+		{[]string{"wwid", "devlinks"}, nil, []string{"^eui\\.", "null"}, []string{"sda"}},
+	}
+
+	for _, tc := range tests {
+		var acc testutil.Accumulator
+		s := &DiskIOStats{
+			ps:               &mps,
+			SkipSerialNumber: true,
+			MatchBy:          tc.matchBy,
+			Devices:          tc.devices,
+			Excludes:         tc.excludes,
+		}
+		require.NoError(t, s.Gather(&acc))
+
+		var names []string
+		for _, m := range acc.Metrics {
+			names = append(names, m.Tags["name"])
+		}
+		sort.Strings(names)
+		assert.Equal(t, tc.expected, names, "match_by: %#v, devices: %#v, excludes: %#v",
+			tc.matchBy, tc.devices, tc.excludes)
+	}
+}
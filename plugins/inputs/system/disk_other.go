@@ -7,3 +7,15 @@ type diskInfoCache struct{}
 func (s *DiskIOStats) diskInfo(devName string) (map[string]string, error) {
 	return nil, nil
 }
+
+func (s *DiskIOStats) diskSysfsFields(devName string) map[string]interface{} {
+	return nil
+}
+
+func (s *DiskIOStats) diskWWID(devName string) string {
+	return ""
+}
+
+func (s *DiskStats) diskLabel(device string) string {
+	return ""
+}
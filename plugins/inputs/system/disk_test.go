@@ -2,9 +2,12 @@ package system
 
 import (
 	"os"
+	"sort"
 	"testing"
+	"time"
 
 	"github.com/influxdata/telegraf/testutil"
+	"github.com/influxdata/toml"
 	"github.com/shirou/gopsutil/disk"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
@@ -69,7 +72,7 @@ func TestDiskUsage(t *testing.T) {
 	require.NoError(t, err)
 
 	numDiskMetrics := acc.NFields()
-	expectedAllDiskMetrics := 14
+	expectedAllDiskMetrics := 22
 	assert.Equal(t, expectedAllDiskMetrics, numDiskMetrics)
 
 	tags1 := map[string]string{
@@ -86,35 +89,43 @@ func TestDiskUsage(t *testing.T) {
 	}
 
 	fields1 := map[string]interface{}{
-		"total":        uint64(128),
-		"used":         uint64(100),
-		"free":         uint64(23),
-		"inodes_total": uint64(1234),
-		"inodes_free":  uint64(234),
-		"inodes_used":  uint64(1000),
-		"used_percent": float64(81.30081300813008),
+		"total":                 uint64(128),
+		"used":                  uint64(100),
+		"free":                  uint64(23),
+		"reserved":              uint64(5),
+		"inodes_total":          uint64(1234),
+		"inodes_free":           uint64(234),
+		"inodes_used":           uint64(1000),
+		"used_percent":          float64(81.30081300813008),
+		"used_percent_by_total": float64(78.125),
+		"inodes_used_percent":   float64(81.03727714748784),
+		"read_only":             1,
 	}
 	fields2 := map[string]interface{}{
-		"total":        uint64(256),
-		"used":         uint64(200),
-		"free":         uint64(46),
-		"inodes_total": uint64(2468),
-		"inodes_free":  uint64(468),
-		"inodes_used":  uint64(2000),
-		"used_percent": float64(81.30081300813008),
+		"total":                 uint64(256),
+		"used":                  uint64(200),
+		"free":                  uint64(46),
+		"reserved":              uint64(10),
+		"inodes_total":          uint64(2468),
+		"inodes_free":           uint64(468),
+		"inodes_used":           uint64(2000),
+		"used_percent":          float64(81.30081300813008),
+		"used_percent_by_total": float64(78.125),
+		"inodes_used_percent":   float64(81.03727714748784),
+		"read_only":             0,
 	}
 	acc.AssertContainsTaggedFields(t, "disk", fields1, tags1)
 	acc.AssertContainsTaggedFields(t, "disk", fields2, tags2)
 
-	// We expect 6 more DiskMetrics to show up with an explicit match on "/"
+	// We expect 11 more DiskMetrics to show up with an explicit match on "/"
 	// and /home not matching the /dev in MountPoints
 	err = (&DiskStats{ps: &mps, MountPoints: []string{"/", "/dev"}}).Gather(&acc)
-	assert.Equal(t, expectedAllDiskMetrics+7, acc.NFields())
+	assert.Equal(t, expectedAllDiskMetrics+11, acc.NFields())
 
 	// We should see all the diskpoints as MountPoints includes both
 	// / and /home
 	err = (&DiskStats{ps: &mps, MountPoints: []string{"/", "/home"}}).Gather(&acc)
-	assert.Equal(t, 2*expectedAllDiskMetrics+7, acc.NFields())
+	assert.Equal(t, 2*expectedAllDiskMetrics+11, acc.NFields())
 }
 
 func TestDiskUsageHostMountPrefix(t *testing.T) {
@@ -149,13 +160,17 @@ func TestDiskUsageHostMountPrefix(t *testing.T) {
 				"mode":   "ro",
 			},
 			expectedFields: map[string]interface{}{
-				"total":        uint64(42),
-				"used":         uint64(0),
-				"free":         uint64(0),
-				"inodes_total": uint64(0),
-				"inodes_free":  uint64(0),
-				"inodes_used":  uint64(0),
-				"used_percent": float64(0),
+				"total":                 uint64(42),
+				"used":                  uint64(0),
+				"free":                  uint64(0),
+				"reserved":              uint64(42),
+				"inodes_total":          uint64(0),
+				"inodes_free":           uint64(0),
+				"inodes_used":           uint64(0),
+				"used_percent":          float64(0),
+				"used_percent_by_total": float64(0),
+				"inodes_used_percent":   float64(0),
+				"read_only":             1,
 			},
 		},
 		{
@@ -182,13 +197,17 @@ func TestDiskUsageHostMountPrefix(t *testing.T) {
 				"mode":   "ro",
 			},
 			expectedFields: map[string]interface{}{
-				"total":        uint64(42),
-				"used":         uint64(0),
-				"free":         uint64(0),
-				"inodes_total": uint64(0),
-				"inodes_free":  uint64(0),
-				"inodes_used":  uint64(0),
-				"used_percent": float64(0),
+				"total":                 uint64(42),
+				"used":                  uint64(0),
+				"free":                  uint64(0),
+				"reserved":              uint64(42),
+				"inodes_total":          uint64(0),
+				"inodes_free":           uint64(0),
+				"inodes_used":           uint64(0),
+				"used_percent":          float64(0),
+				"used_percent_by_total": float64(0),
+				"inodes_used_percent":   float64(0),
+				"read_only":             1,
 			},
 		},
 		{
@@ -215,13 +234,17 @@ func TestDiskUsageHostMountPrefix(t *testing.T) {
 				"mode":   "ro",
 			},
 			expectedFields: map[string]interface{}{
-				"total":        uint64(42),
-				"used":         uint64(0),
-				"free":         uint64(0),
-				"inodes_total": uint64(0),
-				"inodes_free":  uint64(0),
-				"inodes_used":  uint64(0),
-				"used_percent": float64(0),
+				"total":                 uint64(42),
+				"used":                  uint64(0),
+				"free":                  uint64(0),
+				"reserved":              uint64(42),
+				"inodes_total":          uint64(0),
+				"inodes_free":           uint64(0),
+				"inodes_used":           uint64(0),
+				"used_percent":          float64(0),
+				"used_percent_by_total": float64(0),
+				"inodes_used_percent":   float64(0),
+				"read_only":             1,
 			},
 		},
 	}
@@ -251,6 +274,431 @@ func TestDiskUsageHostMountPrefix(t *testing.T) {
 	}
 }
 
+func TestDiskUsageInodeWarnPercent(t *testing.T) {
+	tests := []struct {
+		name             string
+		inodeWarnPercent float64
+		usageStat        *disk.UsageStat
+		expectedFields   map[string]interface{}
+		absentFields     []string
+	}{
+		{
+			name: "threshold unset",
+			usageStat: &disk.UsageStat{
+				Path:        "/",
+				Total:       42,
+				InodesTotal: 100,
+				InodesFree:  5,
+				InodesUsed:  95,
+			},
+			expectedFields: map[string]interface{}{
+				"inodes_used_percent": float64(95),
+			},
+			absentFields: []string{"inodes_exhausted"},
+		},
+		{
+			name:             "below threshold",
+			inodeWarnPercent: 90,
+			usageStat: &disk.UsageStat{
+				Path:        "/",
+				Total:       42,
+				InodesTotal: 100,
+				InodesFree:  20,
+				InodesUsed:  80,
+			},
+			expectedFields: map[string]interface{}{
+				"inodes_used_percent": float64(80),
+				"inodes_exhausted":    0,
+			},
+		},
+		{
+			name:             "threshold reached",
+			inodeWarnPercent: 90,
+			usageStat: &disk.UsageStat{
+				Path:        "/",
+				Total:       42,
+				InodesTotal: 100,
+				InodesFree:  10,
+				InodesUsed:  90,
+			},
+			expectedFields: map[string]interface{}{
+				"inodes_used_percent": float64(90),
+				"inodes_exhausted":    1,
+			},
+		},
+		{
+			name:             "no inodes reported",
+			inodeWarnPercent: 90,
+			usageStat: &disk.UsageStat{
+				Path:  "/",
+				Total: 42,
+			},
+			expectedFields: map[string]interface{}{
+				"inodes_used_percent": float64(0),
+				"inodes_exhausted":    0,
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mck := &mock.Mock{}
+			mps := MockPSDisk{&systemPS{&mockDiskUsage{mck}}, mck}
+			defer mps.AssertExpectations(t)
+
+			var acc testutil.Accumulator
+
+			mps.On("Partitions", true).Return([]disk.PartitionStat{
+				{
+					Device:     "/dev/sda",
+					Mountpoint: "/",
+					Fstype:     "xfs",
+					Opts:       "rw",
+				},
+			}, nil)
+			mps.On("PSDiskUsage", "/").Return(tt.usageStat, nil)
+			mps.On("OSGetenv", "HOST_MOUNT_PREFIX").Return("")
+
+			err := (&DiskStats{ps: mps, InodeWarnPercent: tt.inodeWarnPercent}).Gather(&acc)
+			require.NoError(t, err)
+
+			m, ok := acc.Get("disk")
+			require.True(t, ok)
+			for k, v := range tt.expectedFields {
+				assert.Equal(t, v, m.Fields[k], "field %s", k)
+			}
+			for _, k := range tt.absentFields {
+				assert.False(t, acc.HasField("disk", k), "field %s", k)
+			}
+		})
+	}
+}
+
+func TestDiskUsageMountPointTags(t *testing.T) {
+	mck := &mock.Mock{}
+	mps := MockPSDisk{&systemPS{&mockDiskUsage{mck}}, mck}
+	defer mps.AssertExpectations(t)
+
+	var acc testutil.Accumulator
+
+	psAll := []disk.PartitionStat{
+		{Device: "/dev/sda", Mountpoint: "/", Fstype: "ext4", Opts: "rw"},
+		{Device: "/dev/sdb", Mountpoint: "/data/ssd", Fstype: "ext4", Opts: "rw"},
+		{Device: "/dev/sdc", Mountpoint: "/data/ssd/volume1", Fstype: "ext4", Opts: "rw"},
+		{Device: "/dev/sdd", Mountpoint: "/data/ssdx", Fstype: "ext4", Opts: "rw"},
+		{Device: "/dev/sde", Mountpoint: "/data/hdd", Fstype: "ext4", Opts: "rw"},
+	}
+	mps.On("Partitions", true).Return(psAll, nil)
+	mps.On("OSGetenv", "HOST_MOUNT_PREFIX").Return("")
+	for _, p := range psAll {
+		mps.On("PSDiskUsage", p.Mountpoint).Return(&disk.UsageStat{Path: p.Mountpoint, Total: 42}, nil)
+	}
+
+	d := &DiskStats{
+		ps: mps,
+		MountPointTags: map[string]map[string]string{
+			"/":         {"site": "default"},
+			"/data/ssd": {"tier": "ssd"},
+			"/data/hdd": {"tier": "hdd", "fstype": "bogus", "path": "/bogus"},
+		},
+	}
+	err := d.Gather(&acc)
+	require.NoError(t, err)
+
+	expected := map[string]map[string]string{
+		"/":                 {"device": "sda", "site": "default"},
+		"/data/ssd":         {"device": "sdb", "tier": "ssd"},
+		"/data/ssd/volume1": {"device": "sdc", "tier": "ssd"},
+		"/data/ssdx":        {"device": "sdd", "site": "default"},
+		"/data/hdd":         {"device": "sde", "tier": "hdd"},
+	}
+	require.Len(t, acc.Metrics, len(expected))
+	for _, m := range acc.Metrics {
+		tags := map[string]string{
+			"path":   m.Tags["path"],
+			"fstype": "ext4",
+			"mode":   "rw",
+		}
+		for k, v := range expected[m.Tags["path"]] {
+			tags[k] = v
+		}
+		assert.Equal(t, tags, m.Tags)
+	}
+}
+
+func TestDiskStatsUsedGrowth(t *testing.T) {
+	var mps MockPS
+	defer mps.AssertExpectations(t)
+
+	ps := []*disk.PartitionStat{
+		{Device: "/dev/sda", Mountpoint: "/", Fstype: "ext4", Opts: "rw"},
+	}
+	usage := func(used uint64) []*disk.UsageStat {
+		return []*disk.UsageStat{{Path: "/", Fstype: "ext4", Total: 100000, Used: used}}
+	}
+	mps.On("DiskUsage", []string(nil), nil, []string(nil)).Return(usage(1000), ps, nil).Once()
+	mps.On("DiskUsage", []string(nil), nil, []string(nil)).Return(usage(6000), ps, nil).Once()
+	mps.On("DiskUsage", []string(nil), nil, []string(nil)).Return([]*disk.UsageStat{}, []*disk.PartitionStat{}, nil).Once()
+	mps.On("DiskUsage", []string(nil), nil, []string(nil)).Return(usage(7000), ps, nil).Once()
+
+	s := &DiskStats{ps: &mps, ReportUsedGrowth: true}
+
+	// First gather has nothing to compare with
+	var acc testutil.Accumulator
+	require.NoError(t, s.Gather(&acc))
+	assert.False(t, acc.HasField("disk", "used_growth_bps"))
+
+	acc.ClearMetrics()
+	s.lastTime = s.lastTime.Add(-10 * time.Second)
+	require.NoError(t, s.Gather(&acc))
+	growth, ok := acc.FloatField("disk", "used_growth_bps")
+	require.True(t, ok)
+	assert.InDelta(t, 500, growth, 1)
+
+	// Unmounted, then mounted again: state starts over
+	acc.ClearMetrics()
+	require.NoError(t, s.Gather(&acc))
+	require.NoError(t, s.Gather(&acc))
+	assert.True(t, acc.HasField("disk", "used"))
+	assert.False(t, acc.HasField("disk", "used_growth_bps"))
+}
+
+func TestDiskStatsFieldRename(t *testing.T) {
+	var mps MockPS
+	defer mps.AssertExpectations(t)
+
+	mps.On("DiskUsage", []string(nil), nil, []string(nil)).Return(
+		[]*disk.UsageStat{{Path: "/", Fstype: "ext4", Total: 128, Free: 28, Used: 100}},
+		[]*disk.PartitionStat{{Device: "/dev/sda", Mountpoint: "/", Fstype: "ext4", Opts: "rw"}},
+		nil)
+
+	var acc testutil.Accumulator
+	s := &DiskStats{ps: &mps, FieldRename: map[string]string{"used": "used_bytes"}}
+	require.NoError(t, s.Gather(&acc))
+
+	used, ok := acc.Get("disk")
+	require.True(t, ok)
+	assert.Equal(t, uint64(100), used.Fields["used_bytes"])
+	assert.NotContains(t, used.Fields, "used")
+	assert.Equal(t, uint64(128), used.Fields["total"])
+}
+
+func TestDiskStatsFieldRenameUnknownField(t *testing.T) {
+	var mps MockPS
+	var acc testutil.Accumulator
+
+	s := &DiskStats{ps: &mps, FieldRename: map[string]string{"bogus": "used_bytes"}}
+	assert.Error(t, s.Gather(&acc))
+	mps.AssertNotCalled(t, "DiskUsage", mock.Anything, mock.Anything, mock.Anything)
+}
+
+func TestDiskStatsFieldRenameCollision(t *testing.T) {
+	tests := []struct {
+		mapping map[string]string
+		valid   bool
+	}{
+		{map[string]string{"used": "total"}, false},
+		{map[string]string{"used": "space", "free": "space"}, false},
+		{map[string]string{"used": "total", "total": "size"}, true},
+		{map[string]string{"used": "free", "free": "used"}, true},
+		{map[string]string{"used": "used"}, true},
+	}
+
+	for _, tt := range tests {
+		s := &DiskStats{FieldRename: tt.mapping}
+		err := s.init()
+		if tt.valid {
+			assert.NoError(t, err, "field_rename: %v", tt.mapping)
+		} else {
+			assert.Error(t, err, "field_rename: %v", tt.mapping)
+		}
+	}
+}
+
+func TestDiskStatsUsedPercentFromTotal(t *testing.T) {
+	var mps MockPS
+	defer mps.AssertExpectations(t)
+
+	// 5% of the blocks are reserved for root
+	mps.On("DiskUsage", []string(nil), nil, []string(nil)).Return(
+		[]*disk.UsageStat{{Path: "/", Fstype: "ext4", Total: 1000, Free: 550, Used: 400}},
+		[]*disk.PartitionStat{{Device: "/dev/sda", Mountpoint: "/", Fstype: "ext4", Opts: "rw"}},
+		nil)
+
+	var acc testutil.Accumulator
+	require.NoError(t, (&DiskStats{ps: &mps}).Gather(&acc))
+	usedPercent, ok := acc.FloatField("disk", "used_percent")
+	require.True(t, ok)
+	assert.InDelta(t, 42.105, usedPercent, 0.001)
+
+	acc.ClearMetrics()
+	require.NoError(t, (&DiskStats{ps: &mps, UsedPercentFromTotal: true}).Gather(&acc))
+	usedPercent, ok = acc.FloatField("disk", "used_percent")
+	require.True(t, ok)
+	assert.Equal(t, float64(40), usedPercent)
+}
+
+func TestDiskUsageIgnoreMountPoints(t *testing.T) {
+	mck := &mock.Mock{}
+	mps := MockPSDisk{&systemPS{&mockDiskUsage{mck}}, mck}
+
+	psAll := []disk.PartitionStat{
+		{Device: "/dev/sda", Mountpoint: "/", Fstype: "ext4", Opts: "rw"},
+		{Device: "/dev/sdb", Mountpoint: "/etc", Fstype: "ext4", Opts: "rw"},
+		{Device: "overlay", Mountpoint: "/var/lib/docker/overlay2/0123abcd/merged", Fstype: "overlay", Opts: "rw"},
+	}
+	mps.On("Partitions", true).Return(psAll, nil)
+	mps.On("OSGetenv", "HOST_MOUNT_PREFIX").Return("")
+	for _, p := range psAll {
+		mps.On("PSDiskUsage", p.Mountpoint).Return(&disk.UsageStat{Path: p.Mountpoint, Total: 42}, nil)
+	}
+
+	var acc testutil.Accumulator
+	d := &DiskStats{
+		ps:                mps,
+		IgnoreMountPoints: []string{"/etc", "/var/lib/docker/*"},
+	}
+	require.NoError(t, d.Gather(&acc))
+
+	require.Len(t, acc.Metrics, 1)
+	assert.Equal(t, "/", acc.Metrics[0].Tags["path"])
+	// ignored mount points are skipped before their usage is read
+	mps.AssertNotCalled(t, "PSDiskUsage", "/etc")
+	mps.AssertNotCalled(t, "PSDiskUsage", "/var/lib/docker/overlay2/0123abcd/merged")
+}
+
+func TestDiskStatsReserved(t *testing.T) {
+	tests := []struct {
+		name              string
+		usageStat         *disk.UsageStat
+		reserved          uint64
+		usedPercentTotal  float64
+		usedPercentUsable float64
+	}{
+		{
+			name:              "ext4 with root reserve",
+			usageStat:         &disk.UsageStat{Path: "/", Total: 1000, Used: 400, Free: 550},
+			reserved:          50,
+			usedPercentTotal:  40,
+			usedPercentUsable: 42.10526315789473,
+		},
+		{
+			name:              "no reserve",
+			usageStat:         &disk.UsageStat{Path: "/", Total: 1000, Used: 400, Free: 600},
+			reserved:          0,
+			usedPercentTotal:  40,
+			usedPercentUsable: 40,
+		},
+		{
+			name:              "used and free exceed total",
+			usageStat:         &disk.UsageStat{Path: "/", Total: 1000, Used: 500, Free: 600},
+			reserved:          0,
+			usedPercentTotal:  50,
+			usedPercentUsable: 45.45454545454545,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var mps MockPS
+			mps.On("DiskUsage", []string(nil), nil, []string(nil)).Return(
+				[]*disk.UsageStat{tt.usageStat},
+				[]*disk.PartitionStat{{Device: "/dev/sda", Mountpoint: "/", Fstype: "ext4", Opts: "rw"}},
+				nil)
+
+			var acc testutil.Accumulator
+			require.NoError(t, (&DiskStats{ps: &mps}).Gather(&acc))
+
+			m, ok := acc.Get("disk")
+			require.True(t, ok)
+			assert.Equal(t, tt.reserved, m.Fields["reserved"])
+			assert.Equal(t, tt.usedPercentTotal, m.Fields["used_percent_by_total"])
+			assert.InDelta(t, tt.usedPercentUsable, m.Fields["used_percent"], 1e-9)
+		})
+	}
+}
+
+func TestDiskStatsReportTotal(t *testing.T) {
+	var mps MockPS
+	mps.On("DiskUsage", []string(nil), nil, []string(nil)).Return(
+		[]*disk.UsageStat{
+			{Path: "/", Fstype: "ext4", Total: 1000, Used: 400, Free: 600, InodesTotal: 100, InodesUsed: 10, InodesFree: 90},
+			{Path: "/home", Fstype: "ext4", Total: 3000, Used: 1000, Free: 1900, InodesTotal: 300, InodesUsed: 30, InodesFree: 270},
+			// bind mount of /home, must not be counted twice
+			{Path: "/srv/home", Fstype: "ext4", Total: 3000, Used: 1000, Free: 1900, InodesTotal: 300, InodesUsed: 30, InodesFree: 270},
+			// dummy filesystem, skipped like for the disk measurement
+			{Path: "/proc", Fstype: "proc"},
+			// pseudo filesystems sharing a device name are all counted
+			{Path: "/run", Fstype: "tmpfs", Total: 100, Used: 10, Free: 90},
+			{Path: "/dev/shm", Fstype: "tmpfs", Total: 200, Used: 20, Free: 180},
+		},
+		[]*disk.PartitionStat{
+			{Device: "/dev/sda1", Mountpoint: "/", Fstype: "ext4", Opts: "rw"},
+			{Device: "/dev/sda2", Mountpoint: "/home", Fstype: "ext4", Opts: "rw"},
+			{Device: "/dev/sda2", Mountpoint: "/srv/home", Fstype: "ext4", Opts: "rw"},
+			{Device: "proc", Mountpoint: "/proc", Fstype: "proc", Opts: "rw"},
+			{Device: "tmpfs", Mountpoint: "/run", Fstype: "tmpfs", Opts: "rw"},
+			{Device: "tmpfs", Mountpoint: "/dev/shm", Fstype: "tmpfs", Opts: "rw"},
+		},
+		nil)
+
+	var acc testutil.Accumulator
+	require.NoError(t, (&DiskStats{ps: &mps, ReportTotal: true}).Gather(&acc))
+
+	assert.Len(t, acc.Metrics, 6)
+	acc.AssertContainsFields(t, "disk_total", map[string]interface{}{
+		"total":        uint64(4300),
+		"free":         uint64(2770),
+		"used":         uint64(1430),
+		"used_percent": float64(1430) / float64(4200) * 100,
+		"inodes_total": uint64(400),
+		"inodes_free":  uint64(360),
+		"inodes_used":  uint64(40),
+	})
+
+	// The partitions are reported unchanged
+	var paths []string
+	for _, m := range acc.Metrics {
+		if m.Measurement == "disk" {
+			paths = append(paths, m.Tags["path"])
+		}
+	}
+	sort.Strings(paths)
+	assert.Equal(t, []string{"/", "/dev/shm", "/home", "/run", "/srv/home"}, paths)
+
+	// Off by default
+	acc.ClearMetrics()
+	require.NoError(t, (&DiskStats{ps: &mps}).Gather(&acc))
+	assert.False(t, acc.HasMeasurement("disk_total"))
+}
+
+func TestDiskStatsReportTotalNoSpace(t *testing.T) {
+	var mps MockPS
+	mps.On("DiskUsage", []string(nil), nil, []string(nil)).Return(
+		[]*disk.UsageStat{{Path: "/", Fstype: "ext4", Total: 1000}},
+		[]*disk.PartitionStat{{Device: "/dev/sda1", Mountpoint: "/", Fstype: "ext4", Opts: "rw"}},
+		nil)
+
+	for _, fromTotal := range []bool{false, true} {
+		var acc testutil.Accumulator
+		s := &DiskStats{ps: &mps, ReportTotal: true, UsedPercentFromTotal: fromTotal}
+		require.NoError(t, s.Gather(&acc))
+
+		m, ok := acc.Get("disk_total")
+		require.True(t, ok)
+		assert.Equal(t, float64(0), m.Fields["used_percent"])
+	}
+
+	// Nothing to sum, no measurement
+	var empty MockPS
+	empty.On("DiskUsage", []string(nil), nil, []string(nil)).Return(
+		[]*disk.UsageStat{}, []*disk.PartitionStat{}, nil)
+
+	var acc testutil.Accumulator
+	require.NoError(t, (&DiskStats{ps: &empty, ReportTotal: true}).Gather(&acc))
+	assert.False(t, acc.HasMeasurement("disk_total"))
+}
+
 func TestDiskStats(t *testing.T) {
 	var mps MockPS
 	defer mps.AssertExpectations(t)
@@ -316,15 +764,15 @@ func TestDiskStats(t *testing.T) {
 		},
 	}
 
-	mps.On("DiskUsage", []string(nil), []string(nil)).Return(duAll, psAll, nil)
-	mps.On("DiskUsage", []string{"/", "/dev"}, []string(nil)).Return(duFiltered, psFiltered, nil)
-	mps.On("DiskUsage", []string{"/", "/home"}, []string(nil)).Return(duAll, psAll, nil)
+	mps.On("DiskUsage", []string(nil), nil, []string(nil)).Return(duAll, psAll, nil)
+	mps.On("DiskUsage", []string{"/", "/dev"}, nil, []string(nil)).Return(duFiltered, psFiltered, nil)
+	mps.On("DiskUsage", []string{"/", "/home"}, nil, []string(nil)).Return(duAll, psAll, nil)
 
 	err = (&DiskStats{ps: &mps}).Gather(&acc)
 	require.NoError(t, err)
 
 	numDiskMetrics := acc.NFields()
-	expectedAllDiskMetrics := 14
+	expectedAllDiskMetrics := 22
 	assert.Equal(t, expectedAllDiskMetrics, numDiskMetrics)
 
 	tags1 := map[string]string{
@@ -341,35 +789,43 @@ func TestDiskStats(t *testing.T) {
 	}
 
 	fields1 := map[string]interface{}{
-		"total":        uint64(128),
-		"used":         uint64(100),
-		"free":         uint64(23),
-		"inodes_total": uint64(1234),
-		"inodes_free":  uint64(234),
-		"inodes_used":  uint64(1000),
-		"used_percent": float64(81.30081300813008),
+		"total":                 uint64(128),
+		"used":                  uint64(100),
+		"free":                  uint64(23),
+		"reserved":              uint64(5),
+		"inodes_total":          uint64(1234),
+		"inodes_free":           uint64(234),
+		"inodes_used":           uint64(1000),
+		"used_percent":          float64(81.30081300813008),
+		"used_percent_by_total": float64(78.125),
+		"inodes_used_percent":   float64(81.03727714748784),
+		"read_only":             1,
 	}
 	fields2 := map[string]interface{}{
-		"total":        uint64(256),
-		"used":         uint64(200),
-		"free":         uint64(46),
-		"inodes_total": uint64(2468),
-		"inodes_free":  uint64(468),
-		"inodes_used":  uint64(2000),
-		"used_percent": float64(81.30081300813008),
+		"total":                 uint64(256),
+		"used":                  uint64(200),
+		"free":                  uint64(46),
+		"reserved":              uint64(10),
+		"inodes_total":          uint64(2468),
+		"inodes_free":           uint64(468),
+		"inodes_used":           uint64(2000),
+		"used_percent":          float64(81.30081300813008),
+		"used_percent_by_total": float64(78.125),
+		"inodes_used_percent":   float64(81.03727714748784),
+		"read_only":             0,
 	}
 	acc.AssertContainsTaggedFields(t, "disk", fields1, tags1)
 	acc.AssertContainsTaggedFields(t, "disk", fields2, tags2)
 
-	// We expect 6 more DiskMetrics to show up with an explicit match on "/"
+	// We expect 11 more DiskMetrics to show up with an explicit match on "/"
 	// and /home not matching the /dev in MountPoints
 	err = (&DiskStats{ps: &mps, MountPoints: []string{"/", "/dev"}}).Gather(&acc)
-	assert.Equal(t, expectedAllDiskMetrics+7, acc.NFields())
+	assert.Equal(t, expectedAllDiskMetrics+11, acc.NFields())
 
 	// We should see all the diskpoints as MountPoints includes both
 	// / and /home
 	err = (&DiskStats{ps: &mps, MountPoints: []string{"/", "/home"}}).Gather(&acc)
-	assert.Equal(t, 2*expectedAllDiskMetrics+7, acc.NFields())
+	assert.Equal(t, 2*expectedAllDiskMetrics+11, acc.NFields())
 }
 
 // func TestDiskIOStats(t *testing.T) {
@@ -453,3 +909,497 @@ func TestDiskStats(t *testing.T) {
 // 	assert.True(t, acc.CheckTaggedValue("write_time", uint64(6087), dtags3))
 // 	assert.True(t, acc.CheckTaggedValue("io_time", uint64(246552), dtags3))
 // }
+
+func TestDiskIOStatsAwait(t *testing.T) {
+	var mps MockPS
+	mps.On("DiskIO").Return(map[string]disk.IOCountersStat{
+		"sda": {Name: "sda", ReadCount: 100, ReadTime: 100, WriteCount: 50, WriteTime: 200},
+	}, nil).Once()
+	mps.On("DiskIO").Return(map[string]disk.IOCountersStat{
+		"sda": {Name: "sda", ReadCount: 110, ReadTime: 130, WriteCount: 60, WriteTime: 250},
+	}, nil).Once()
+
+	s := &DiskIOStats{ps: &mps, SkipSerialNumber: true}
+	var acc testutil.Accumulator
+	require.NoError(t, s.Gather(&acc))
+	require.NoError(t, s.Gather(&acc))
+
+	// 30 ms over 10 reads, 50 ms over 10 writes
+	readAwait, ok := acc.FloatField("diskio", "read_await")
+	require.True(t, ok, "read_await")
+	assert.Equal(t, 3.0, readAwait)
+	writeAwait, ok := acc.FloatField("diskio", "write_await")
+	require.True(t, ok, "write_await")
+	assert.Equal(t, 5.0, writeAwait)
+	assert.False(t, acc.HasField("diskio", "read_awit"))
+	assert.False(t, acc.HasField("diskio", "write_awit"))
+}
+
+func TestDiskIOStatsLatencyBuckets(t *testing.T) {
+	samples := []disk.IOCountersStat{
+		{Name: "sda", ReadCount: 100, ReadTime: 100},
+		// 10 reads in 20ms: 2ms average
+		{Name: "sda", ReadCount: 110, ReadTime: 120},
+		// 10 reads in 200ms: 20ms average
+		{Name: "sda", ReadCount: 120, ReadTime: 320},
+		// counters wrapped
+		{Name: "sda", ReadCount: 5, ReadTime: 10},
+		// 5 reads in 5ms: 1ms average
+		{Name: "sda", ReadCount: 10, ReadTime: 15},
+	}
+	expected := []map[string]interface{}{
+		nil,
+		{"latency_le_1ms": uint64(0), "latency_le_10ms": uint64(1), "latency_le_inf": uint64(1)},
+		{"latency_le_1ms": uint64(0), "latency_le_10ms": uint64(1), "latency_le_inf": uint64(2)},
+		{"latency_le_1ms": uint64(0), "latency_le_10ms": uint64(0), "latency_le_inf": uint64(0)},
+		{"latency_le_1ms": uint64(1), "latency_le_10ms": uint64(1), "latency_le_inf": uint64(1)},
+	}
+
+	var mps MockPS
+	s := &DiskIOStats{
+		ps:                   &mps,
+		SkipSerialNumber:     true,
+		ReportLatencyBuckets: true,
+		LatencyBucketsMs:     []float64{1, 10},
+	}
+	for i, sample := range samples {
+		mps.On("DiskIO").Return(map[string]disk.IOCountersStat{"sda": sample}, nil).Once()
+
+		var acc testutil.Accumulator
+		require.NoError(t, s.Gather(&acc))
+
+		if expected[i] == nil {
+			assert.False(t, acc.HasField("diskio", "latency_le_inf"))
+			continue
+		}
+		buckets := acc.Metrics[len(acc.Metrics)-1]
+		assert.Equal(t, map[string]string{"name": "sda"}, buckets.Tags)
+		assert.Equal(t, expected[i], buckets.Fields, "sample %d", i)
+	}
+}
+
+func TestDiskIOStatsLatencyBucketsDisabled(t *testing.T) {
+	var mps MockPS
+	mps.On("DiskIO").Return(map[string]disk.IOCountersStat{
+		"sda": {Name: "sda", ReadCount: 100, ReadTime: 100},
+	}, nil).Once()
+	mps.On("DiskIO").Return(map[string]disk.IOCountersStat{
+		"sda": {Name: "sda", ReadCount: 110, ReadTime: 120},
+	}, nil).Once()
+
+	s := &DiskIOStats{ps: &mps, SkipSerialNumber: true}
+	var acc testutil.Accumulator
+	require.NoError(t, s.Gather(&acc))
+	require.NoError(t, s.Gather(&acc))
+
+	assert.True(t, acc.HasField("diskio", "read_await"))
+	assert.False(t, acc.HasField("diskio", "latency_le_inf"))
+}
+
+func TestDiskIOStatsFieldRename(t *testing.T) {
+	var mps MockPS
+	mps.On("DiskIO").Return(map[string]disk.IOCountersStat{
+		"sda": {Name: "sda", ReadCount: 100, ReadTime: 100, ReadBytes: 4096},
+	}, nil).Once()
+	mps.On("DiskIO").Return(map[string]disk.IOCountersStat{
+		"sda": {Name: "sda", ReadCount: 110, ReadTime: 120, ReadBytes: 8192},
+	}, nil).Once()
+
+	s := &DiskIOStats{
+		ps:                   &mps,
+		SkipSerialNumber:     true,
+		ReportLatencyBuckets: true,
+		FieldRename: map[string]string{
+			"read_bytes":     "read_bytes_total",
+			"read_await":     "read_latency",
+			"latency_le_5ms": "fast_reads",
+		},
+	}
+	var acc testutil.Accumulator
+	require.NoError(t, s.Gather(&acc))
+	require.NoError(t, s.Gather(&acc))
+
+	assert.True(t, acc.HasField("diskio", "read_bytes_total"))
+	assert.False(t, acc.HasField("diskio", "read_bytes"))
+	assert.True(t, acc.HasField("diskio", "read_latency"))
+	assert.False(t, acc.HasField("diskio", "read_await"))
+	assert.True(t, acc.HasField("diskio", "fast_reads"))
+	assert.False(t, acc.HasField("diskio", "latency_le_5ms"))
+}
+
+func TestDiskIOStatsFieldRenameUnknownField(t *testing.T) {
+	var mps MockPS
+	var acc testutil.Accumulator
+
+	s := &DiskIOStats{ps: &mps, FieldRename: map[string]string{"read_awit": "read_await"}}
+	assert.Error(t, s.Gather(&acc))
+}
+
+func TestDiskIOStatsFieldRenameCollision(t *testing.T) {
+	for _, mapping := range []map[string]string{
+		{"read_bytes": "write_bytes"},
+		{"read_bytes": "bytes", "write_bytes": "bytes"},
+		{"read_iops": "latency_le_10ms"},
+	} {
+		s := &DiskIOStats{FieldRename: mapping}
+		assert.Error(t, s.init(), "field_rename: %v", mapping)
+	}
+
+	s := &DiskIOStats{FieldRename: map[string]string{"read_bytes": "rbytes", "write_bytes": "wbytes"}}
+	assert.NoError(t, s.init())
+}
+
+func TestDiskIOStatsMeasurementName(t *testing.T) {
+	var mps MockPS
+	mps.On("DiskIO").Return(map[string]disk.IOCountersStat{
+		"sda": {Name: "sda", ReadCount: 100},
+	}, nil)
+
+	var acc testutil.Accumulator
+	require.NoError(t, (&DiskIOStats{ps: &mps, SkipSerialNumber: true}).Gather(&acc))
+	assert.True(t, acc.HasMeasurement("diskio"))
+
+	acc.ClearMetrics()
+	s := &DiskIOStats{ps: &mps, SkipSerialNumber: true, MeasurementName: "diskio_lvm"}
+	require.NoError(t, s.Gather(&acc))
+	require.NoError(t, s.Gather(&acc))
+	assert.False(t, acc.HasMeasurement("diskio"))
+	for _, m := range acc.Metrics {
+		assert.Equal(t, "diskio_lvm", m.Measurement)
+	}
+	reads, ok := acc.Get("diskio_lvm")
+	require.True(t, ok)
+	assert.Equal(t, uint64(100), reads.Fields["reads"])
+}
+
+func TestDiskIOStatsCounterWrap(t *testing.T) {
+	var mps MockPS
+	mps.On("DiskIO").Return(map[string]disk.IOCountersStat{
+		"sda": {Name: "sda", ReadCount: 1000, ReadBytes: 4096000},
+	}, nil).Once()
+	mps.On("DiskIO").Return(map[string]disk.IOCountersStat{
+		"sda": {Name: "sda", ReadCount: 10, ReadBytes: 40960},
+	}, nil).Once()
+	mps.On("DiskIO").Return(map[string]disk.IOCountersStat{
+		"sda": {Name: "sda", ReadCount: 20, ReadBytes: 81920},
+	}, nil).Once()
+
+	s := &DiskIOStats{ps: &mps, SkipSerialNumber: true}
+
+	var acc testutil.Accumulator
+	require.NoError(t, s.Gather(&acc))
+	assert.False(t, acc.HasField("diskio", "counter_wrap"))
+
+	acc.ClearMetrics()
+	require.NoError(t, s.Gather(&acc))
+	wrap, ok := acc.IntField("diskio", "counter_wrap")
+	require.True(t, ok)
+	assert.Equal(t, 1, wrap)
+	reads, ok := acc.Get("diskio")
+	require.True(t, ok)
+	assert.Equal(t, uint64(10), reads.Fields["reads"])
+	assert.False(t, acc.HasField("diskio", "read_iops"))
+	assert.False(t, acc.HasField("diskio", "read_bps"))
+
+	// Rates are back once there is a valid delta
+	acc.ClearMetrics()
+	require.NoError(t, s.Gather(&acc))
+	assert.False(t, acc.HasField("diskio", "counter_wrap"))
+	readBps, ok := acc.FloatField("diskio", "read_bps")
+	require.True(t, ok)
+	assert.True(t, readBps > 0)
+}
+
+func TestDiskIOStatsExcludes(t *testing.T) {
+	var mps MockPS
+	mps.On("DiskIO").Return(map[string]disk.IOCountersStat{
+		"sda":   {Name: "sda"},
+		"sda1":  {Name: "sda1"},
+		"loop0": {Name: "loop0"},
+		"ram0":  {Name: "ram0"},
+	}, nil)
+
+	tests := []struct {
+		excludes []string
+		expected []string
+	}{
+		{nil, []string{"loop0", "ram0", "sda", "sda1"}},
+		{[]string{""}, []string{"loop0", "ram0", "sda", "sda1"}},
+		{[]string{"", "^loop"}, []string{"ram0", "sda", "sda1"}},
+		{[]string{"^loop"}, []string{"ram0", "sda", "sda1"}},
+		{[]string{"^loop", "^ram", "[0-9]$"}, []string{"sda"}},
+	}
+
+	for _, tc := range tests {
+		var acc testutil.Accumulator
+		s := &DiskIOStats{ps: &mps, SkipSerialNumber: true, Excludes: tc.excludes}
+		require.NoError(t, s.Gather(&acc))
+
+		var names []string
+		for _, m := range acc.Metrics {
+			names = append(names, m.Tags["name"])
+		}
+		sort.Strings(names)
+		assert.Equal(t, tc.expected, names, "excludes: %#v", tc.excludes)
+	}
+}
+
+func TestDiskIOStatsExcludesConfig(t *testing.T) {
+	tests := []struct {
+		config   string
+		expected excludeList
+	}{
+		{`excludes = "^loop"`, excludeList{"^loop"}},
+		{`excludes = ["^loop", "^ram"]`, excludeList{"^loop", "^ram"}},
+		{`excludes = []`, excludeList{}},
+	}
+
+	for _, tc := range tests {
+		var s DiskIOStats
+		require.NoError(t, toml.Unmarshal([]byte(tc.config), &s), tc.config)
+		assert.Equal(t, tc.expected, s.Excludes, tc.config)
+	}
+
+	var s DiskIOStats
+	assert.Error(t, toml.Unmarshal([]byte(`excludes = 42`), &s))
+
+	// An empty string excludes nothing
+	var mps MockPS
+	mps.On("DiskIO").Return(map[string]disk.IOCountersStat{
+		"sda":   {Name: "sda"},
+		"loop0": {Name: "loop0"},
+	}, nil)
+	var acc testutil.Accumulator
+	s = DiskIOStats{ps: &mps, SkipSerialNumber: true}
+	require.NoError(t, toml.Unmarshal([]byte(`excludes = ""`), &s))
+	require.NoError(t, s.Gather(&acc))
+	assert.Len(t, acc.Metrics, 2)
+}
+
+func TestDiskIOStatsInvalidExclude(t *testing.T) {
+	var mps MockPS
+	var acc testutil.Accumulator
+
+	s := &DiskIOStats{ps: &mps, Excludes: []string{"^loop", "sd[a-"}}
+	err := s.init()
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "sd[a-")
+
+	// Gather reports the config error instead of panicking
+	assert.Error(t, s.Gather(&acc))
+	mps.AssertNotCalled(t, "DiskIO")
+}
+
+func TestDiskIOStatsMatchBy(t *testing.T) {
+	var mps MockPS
+	mps.On("DiskIO").Return(map[string]disk.IOCountersStat{
+		"nvme0n1": {Name: "nvme0n1", SerialNumber: "S4EWNX0N123456"},
+		"nvme1n1": {Name: "nvme1n1", SerialNumber: "S4EWNX0N654321"},
+		"sda":     {Name: "sda"},
+	}, nil)
+
+	tests := []struct {
+		matchBy  []string
+		devices  []string
+		excludes []string
+		expected []string
+	}{
+		{[]string{"serial"}, []string{"S4EWNX0N654321"}, nil, []string{"nvme1n1"}},
+		{[]string{"serial"}, []string{"nvme1n1"}, nil, nil},
+		{[]string{"name", "serial"}, []string{"sda", "S4EWNX0N123456"}, nil, []string{"nvme0n1", "sda"}},
+		{nil, nil, []string{"^S4EWNX0N1"}, []string{"nvme0n1", "nvme1n1", "sda"}},
+		{[]string{"serial"}, nil, []string{"^S4EWNX0N1"}, []string{"nvme1n1", "sda"}},
+		{[]string{"name", "serial"}, nil, []string{"^S4EWNX0N1", "^sd"}, []string{"nvme1n1"}},
+	}
+
+	for _, tc := range tests {
+		var acc testutil.Accumulator
+		s := &DiskIOStats{
+			ps:               &mps,
+			SkipSerialNumber: true,
+			MatchBy:          tc.matchBy,
+			Devices:          tc.devices,
+			Excludes:         tc.excludes,
+		}
+		require.NoError(t, s.Gather(&acc))
+
+		var names []string
+		for _, m := range acc.Metrics {
+			names = append(names, m.Tags["name"])
+		}
+		sort.Strings(names)
+		assert.Equal(t, tc.expected, names, "match_by: %#v, devices: %#v, excludes: %#v",
+			tc.matchBy, tc.devices, tc.excludes)
+	}
+}
+
+func TestDiskIOStatsInvalidMatchBy(t *testing.T) {
+	var mps MockPS
+	var acc testutil.Accumulator
+
+	s := &DiskIOStats{ps: &mps, MatchBy: []string{"name", "uuid"}}
+	err := s.Gather(&acc)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "uuid")
+	mps.AssertNotCalled(t, "DiskIO")
+}
+
+func TestDiskIOParentController(t *testing.T) {
+	tests := []struct {
+		name       string
+		parent     string
+		controller string
+	}{
+		{"nvme0n1", "nvme0n1", "nvme0"},
+		{"nvme0n1p2", "nvme0n1", "nvme0"},
+		{"nvme12n3", "nvme12n3", "nvme12"},
+		{"sda", "sda", "sda"},
+		{"sda1", "sda", "sda"},
+		{"sdab12", "sdab", "sdab"},
+		{"vdb3", "vdb", "vdb"},
+		{"xvda1", "xvda", "xvda"},
+		{"mmcblk0p1", "mmcblk0", "mmcblk0"},
+		{"dm-0", "dm-0", "dm-0"},
+		{"md127", "md127", "md127"},
+		{"loop0", "loop0", "loop0"},
+	}
+
+	for _, tt := range tests {
+		parent := diskIOParent(tt.name)
+		assert.Equal(t, tt.parent, parent, tt.name)
+		assert.Equal(t, tt.controller, diskIOController(parent), tt.name)
+	}
+}
+
+func TestDiskIOStatsAggregates(t *testing.T) {
+	var mps MockPS
+	mps.On("DiskIO").Return(map[string]disk.IOCountersStat{
+		"nvme0n1":   {Name: "nvme0n1", ReadCount: 100, ReadTime: 200, ReadBytes: 1000},
+		"nvme0n1p1": {Name: "nvme0n1p1", ReadCount: 60, ReadTime: 120, ReadBytes: 600},
+		"nvme0n2":   {Name: "nvme0n2", ReadCount: 50, ReadTime: 300, ReadBytes: 500},
+		"nvme1n1p1": {Name: "nvme1n1p1", ReadCount: 10, ReadTime: 10, ReadBytes: 100},
+		"nvme1n1p2": {Name: "nvme1n1p2", ReadCount: 20, ReadTime: 20, ReadBytes: 200},
+		"sda":       {Name: "sda", WriteCount: 30, WriteTime: 90},
+		"sda1":      {Name: "sda1", WriteCount: 30, WriteTime: 90},
+		"dm-0":      {Name: "dm-0", WriteCount: 5},
+	}, nil).Once()
+	mps.On("DiskIO").Return(map[string]disk.IOCountersStat{
+		"nvme0n1":   {Name: "nvme0n1", ReadCount: 110, ReadTime: 210, ReadBytes: 1100},
+		"nvme0n1p1": {Name: "nvme0n1p1", ReadCount: 70, ReadTime: 130, ReadBytes: 700},
+		"nvme0n2":   {Name: "nvme0n2", ReadCount: 60, ReadTime: 350, ReadBytes: 600},
+		"nvme1n1p1": {Name: "nvme1n1p1", ReadCount: 10, ReadTime: 10, ReadBytes: 100},
+		"nvme1n1p2": {Name: "nvme1n1p2", ReadCount: 20, ReadTime: 20, ReadBytes: 200},
+		"sda":       {Name: "sda", WriteCount: 40, WriteTime: 100},
+		"sda1":      {Name: "sda1", WriteCount: 40, WriteTime: 100},
+		"dm-0":      {Name: "dm-0", WriteCount: 5},
+	}, nil).Once()
+
+	s := &DiskIOStats{
+		ps:               &mps,
+		SkipSerialNumber: true,
+		ReportAggregates: true,
+		Excludes:         []string{"^dm-"},
+	}
+
+	var acc testutil.Accumulator
+	require.NoError(t, s.Gather(&acc))
+
+	counters := map[string]map[string]interface{}{}
+	for _, m := range acc.Metrics {
+		if m.Measurement == "diskio_aggregate" {
+			counters[m.Tags["name"]] = m.Fields
+		}
+	}
+	require.Len(t, counters, 3)
+	// nvme0n1p1 is part of nvme0n1, which was gathered
+	assert.Equal(t, uint64(150), counters["nvme0"]["reads"])
+	assert.Equal(t, uint64(1500), counters["nvme0"]["read_bytes"])
+	// without the disk, its partitions are counted
+	assert.Equal(t, uint64(30), counters["nvme1"]["reads"])
+	assert.Equal(t, uint64(30), counters["sda"]["writes"])
+
+	acc.ClearMetrics()
+	require.NoError(t, s.Gather(&acc))
+
+	rates := map[string]map[string]interface{}{}
+	for _, m := range acc.Metrics {
+		if m.Measurement == "diskio_aggregate" {
+			if _, ok := m.Fields["await"]; ok {
+				rates[m.Tags["name"]] = m.Fields
+			}
+		}
+	}
+	require.Len(t, rates, 3)
+	// (10+50) ms over (10+10) reads
+	assert.Equal(t, 3.0, rates["nvme0"]["read_await"])
+	assert.Equal(t, 0.0, rates["nvme1"]["read_await"])
+	assert.Equal(t, 1.0, rates["sda"]["write_await"])
+	// (100+100) bytes over (10+10) reads
+	assert.InDelta(t, 10.0,
+		rates["nvme0"]["read_bps"].(float64)/rates["nvme0"]["read_iops"].(float64), 1e-9)
+
+	// Off by default
+	var plain MockPS
+	plain.On("DiskIO").Return(map[string]disk.IOCountersStat{"sda": {Name: "sda"}}, nil)
+	acc.ClearMetrics()
+	require.NoError(t, (&DiskIOStats{ps: &plain, SkipSerialNumber: true}).Gather(&acc))
+	assert.False(t, acc.HasMeasurement("diskio_aggregate"))
+}
+
+func TestDiskIOStatsAggregatesDeviceReturns(t *testing.T) {
+	var mps MockPS
+	mps.On("DiskIO").Return(map[string]disk.IOCountersStat{
+		"nvme0n1": {Name: "nvme0n1", ReadCount: 100, ReadTime: 100, ReadBytes: 1000},
+		"nvme0n2": {Name: "nvme0n2", ReadCount: 5000, ReadTime: 50000, ReadBytes: 5000000},
+	}, nil).Once()
+	mps.On("DiskIO").Return(map[string]disk.IOCountersStat{
+		"nvme0n1": {Name: "nvme0n1", ReadCount: 110, ReadTime: 110, ReadBytes: 1100},
+	}, nil).Once()
+	mps.On("DiskIO").Return(map[string]disk.IOCountersStat{
+		"nvme0n1": {Name: "nvme0n1", ReadCount: 120, ReadTime: 120, ReadBytes: 1200},
+		"nvme0n2": {Name: "nvme0n2", ReadCount: 5010, ReadTime: 50100, ReadBytes: 5000100},
+	}, nil).Once()
+	mps.On("DiskIO").Return(map[string]disk.IOCountersStat{
+		"nvme0n1": {Name: "nvme0n1", ReadCount: 130, ReadTime: 130, ReadBytes: 1300},
+		"nvme0n2": {Name: "nvme0n2", ReadCount: 5020, ReadTime: 50200, ReadBytes: 5000200},
+	}, nil).Once()
+
+	s := &DiskIOStats{ps: &mps, SkipSerialNumber: true, ReportAggregates: true}
+
+	gather := func() (counters, rates map[string]interface{}) {
+		var acc testutil.Accumulator
+		require.NoError(t, s.Gather(&acc))
+		for _, m := range acc.Metrics {
+			if m.Measurement != "diskio_aggregate" {
+				continue
+			}
+			if _, ok := m.Fields["await"]; ok {
+				rates = m.Fields
+			} else {
+				counters = m.Fields
+			}
+		}
+		return counters, rates
+	}
+
+	gather()
+
+	// nvme0n2 is gone, only nvme0n1 contributes
+	counters, rates := gather()
+	assert.Equal(t, uint64(110), counters["reads"])
+	require.NotNil(t, rates)
+	assert.Equal(t, 1.0, rates["read_await"])
+
+	// nvme0n2 is back, its lifetime counters are not a delta
+	counters, rates = gather()
+	assert.Equal(t, uint64(5130), counters["reads"])
+	require.NotNil(t, rates)
+	assert.Equal(t, 1.0, rates["read_await"])
+	assert.InDelta(t, 10.0,
+		rates["read_bps"].(float64)/rates["read_iops"].(float64), 1e-9)
+
+	// Both devices have a delta again: (10+100) ms over (10+10) reads
+	_, rates = gather()
+	require.NotNil(t, rates)
+	assert.Equal(t, 5.5, rates["read_await"])
+}
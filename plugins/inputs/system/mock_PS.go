@@ -5,6 +5,8 @@ import (
 
 	"github.com/stretchr/testify/mock"
 
+	"github.com/influxdata/telegraf/filter"
+
 	"github.com/shirou/gopsutil/cpu"
 	"github.com/shirou/gopsutil/disk"
 
@@ -46,7 +48,9 @@ func (m *MockPS) CPUTimes(perCPU, totalCPU bool) ([]cpu.TimesStat, error) {
 }
 
 func (m *MockPS) DiskUsage(
-	mountPointFilter, ignoreMountPointFilter, fstypeExclude []string,
+	mountPointFilter []string,
+	ignoreMountPointFilter filter.Filter,
+	fstypeExclude []string,
 ) ([]*disk.UsageStat, []*disk.PartitionStat, error) {
 	ret := m.Called(mountPointFilter, ignoreMountPointFilter, fstypeExclude)
 
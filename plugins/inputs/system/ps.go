@@ -6,6 +6,7 @@ import (
 	"strings"
 
 	"github.com/influxdata/telegraf"
+	"github.com/influxdata/telegraf/filter"
 	"github.com/influxdata/telegraf/internal"
 
 	"github.com/shirou/gopsutil/cpu"
@@ -16,7 +17,7 @@ import (
 
 type PS interface {
 	CPUTimes(perCPU, totalCPU bool) ([]cpu.TimesStat, error)
-	DiskUsage(mountPointFilter, ignoreMountPointFilter, fstypeExclude []string) ([]*disk.UsageStat, []*disk.PartitionStat, error)
+	DiskUsage(mountPointFilter []string, ignoreMountPointFilter filter.Filter, fstypeExclude []string) ([]*disk.UsageStat, []*disk.PartitionStat, error)
 	NetIO() ([]net.IOCountersStat, error)
 	NetProto() ([]net.ProtoCountersStat, error)
 	DiskIO(names []string) (map[string]disk.IOCountersStat, error)
@@ -69,7 +70,9 @@ func (s *systemPS) CPUTimes(perCPU, totalCPU bool) ([]cpu.TimesStat, error) {
 }
 
 func (s *systemPS) DiskUsage(
-	mountPointFilter, ignoreMountPointFilter, fstypeExclude []string,
+	mountPointFilter []string,
+	ignoreMountPointFilter filter.Filter,
+	fstypeExclude []string,
 ) ([]*disk.UsageStat, []*disk.PartitionStat, error) {
 	parts, err := s.Partitions(true)
 	if err != nil {
@@ -81,11 +84,6 @@ func (s *systemPS) DiskUsage(
 	for _, filter := range mountPointFilter {
 		mountPointFilterSet[filter] = true
 	}
-	ignoreMountPointFilterSet := make(map[string]bool)
-	for _, filter := range ignoreMountPointFilter {
-		ignoreMountPointFilterSet[filter] = true
-	}
-
 	fstypeExcludeSet := make(map[string]bool)
 	for _, filter := range fstypeExclude {
 		fstypeExcludeSet[filter] = true
@@ -115,10 +113,12 @@ func (s *systemPS) DiskUsage(
 			}
 		}
 
-		if len(ignoreMountPointFilter) > 0 {
-			// If the mount point is a member of the filter set,
-			// don't gather info on it.
-			if _, ok := ignoreMountPointFilterSet[p.Mountpoint]; ok {
+		path := filepath.Join("/", strings.TrimPrefix(p.Mountpoint, hostMountPrefix))
+
+		if ignoreMountPointFilter != nil {
+			// If the mount point matches the ignore filter, don't gather
+			// info on it, so an ignored hung mount is not stat'ed either.
+			if ignoreMountPointFilter.Match(p.Mountpoint) || ignoreMountPointFilter.Match(path) {
 				continue
 			}
 		}
@@ -142,7 +142,7 @@ func (s *systemPS) DiskUsage(
 			continue
 		}
 
-		du.Path = filepath.Join("/", strings.TrimPrefix(p.Mountpoint, hostMountPrefix))
+		du.Path = path
 		du.Fstype = p.Fstype
 		usage = append(usage, du)
 		partitions = append(partitions, &p)